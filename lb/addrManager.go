@@ -1,32 +1,310 @@
 package main
 
-import "net"
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
 
-import "fmt"
+type releasedTuple struct {
+	tuple    string
+	released time.Time
+}
+
+type QuarantinedTuple struct {
+	Tuple    string    `json:"tuple"`
+	Released time.Time `json:"released"`
+}
 
-func newAddrManager(addrRange string) (*AddrManager, error) {
+func newAddrManager(addrRange string, portRange string, quarantine time.Duration) (*AddrManager, error) {
 	_, ipnet, err := net.ParseCIDR(addrRange)
 	if err != nil {
 		return nil, err
 	}
-	var ip [16]byte
-	copy(ip[:], ipnet.IP)
+	ones, bits := ipnet.Mask.Size()
+	size := new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
+	first := big.NewInt(0)
+	if size.Cmp(big.NewInt(1)) > 0 {
+		first = big.NewInt(1)
+	}
+	portMin, portMax := 0, 0
+	if portRange != "" {
+		portMin, portMax, err = parsePortRange(portRange)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ports := big.NewInt(int64(portMax - portMin + 1))
 	return &AddrManager{
-		AddrRange: ipnet,
-		Current:   ip,
+		AddrRange:  ipnet,
+		PortMin:    uint16(portMin),
+		PortMax:    uint16(portMax),
+		Quarantine: quarantine,
+		base:       new(big.Int).SetBytes(ipnet.IP),
+		first:      first,
+		ports:      ports,
+		size:       new(big.Int).Mul(new(big.Int).Sub(size, first), ports),
+		next:       big.NewInt(0),
+		inUse:      map[string]bool{},
+		lent:       map[string]bool{},
+		released:   []releasedTuple{},
+		releasedAt: map[string]time.Time{},
+		mutex:      new(sync.Mutex),
 	}, nil
 }
 
+func parsePortRange(portRange string) (int, int, error) {
+	bounds := strings.Split(portRange, "-")
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range: %s", portRange)
+	}
+	min, err := strconv.ParseUint(bounds[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	max, err := strconv.ParseUint(bounds[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	if min == 0 || min > max {
+		return 0, 0, fmt.Errorf("invalid port range: %s", portRange)
+	}
+	return int(min), int(max), nil
+}
+
 type AddrManager struct {
-	AddrRange *net.IPNet
-	Current   [16]byte
+	AddrRange  *net.IPNet
+	PortMin    uint16
+	PortMax    uint16
+	Quarantine time.Duration
+
+	base        *big.Int
+	first       *big.Int
+	ports       *big.Int
+	size        *big.Int
+	next        *big.Int
+	inUse       map[string]bool
+	lent        map[string]bool
+	released    []releasedTuple
+	releasedAt  map[string]time.Time
+	allocations uint64
+	exhaustions uint64
+	mutex       *sync.Mutex
+}
+
+type AddrStats struct {
+	Size        float64
+	InUse       int
+	Lent        int
+	Quarantined int
+	Allocations uint64
+	Exhaustions uint64
 }
 
-func (am *AddrManager) releaseIP() (net.IP, error) {
-	am.Current[15]++
-	addr := net.IP(am.Current[:])
+// Allocate reuses released tuples once their quarantine is over before it
+// takes fresh ones, so the released queue stays bounded even when the range
+// is never used up.
+func (am *AddrManager) Allocate() (net.IP, uint16, error) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	for len(am.released) > 0 && time.Since(am.released[0].released) >= am.Quarantine {
+		released := am.released[0]
+		am.released = am.released[1:]
+		// the tuple may have been reclaimed or released again since queued
+		if at, ok := am.releasedAt[released.tuple]; !ok || !at.Equal(released.released) {
+			continue
+		}
+		addr, port := parseTupleKey(released.tuple)
+		return am.take(addr, port)
+	}
+	for am.next.Cmp(am.size) < 0 {
+		addr, port := am.tuple(am.next)
+		am.next.Add(am.next, big.NewInt(1))
+		key := am.key(addr, port)
+		if _, quarantined := am.releasedAt[key]; !am.inUse[key] && !am.lent[key] && !quarantined {
+			return am.take(addr, port)
+		}
+	}
+	am.exhaustions++
+	return nil, 0, fmt.Errorf("Insufficient address")
+}
+
+func (am *AddrManager) Release(addr net.IP, port uint16) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	key := am.key(addr, port)
+	if !am.inUse[key] && !am.lent[key] {
+		return
+	}
+	delete(am.inUse, key)
+	delete(am.lent, key)
+	am.quarantine(key, time.Now())
+}
+
+func (am *AddrManager) Lend(addr net.IP, port uint16) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	key := am.key(addr, port)
+	if !am.inUse[key] {
+		return
+	}
+	delete(am.inUse, key)
+	am.lent[key] = true
+}
+
+func (am *AddrManager) Return(addr net.IP, port uint16) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	key := am.key(addr, port)
+	if !am.lent[key] {
+		return
+	}
+	delete(am.lent, key)
+	am.quarantine(key, time.Now())
+}
+
+func (am *AddrManager) Reclaim(addr net.IP, port uint16) bool {
+	if !am.Owns(addr, port) {
+		return false
+	}
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	key := am.key(addr, port)
+	delete(am.lent, key)
+	delete(am.releasedAt, key)
+	am.inUse[key] = true
+	return true
+}
+
+func (am *AddrManager) LentTuples() []string {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	tuples := []string{}
+	for key := range am.lent {
+		tuples = append(tuples, key)
+	}
+	return tuples
+}
+
+func (am *AddrManager) RestoreLent(tuples []string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	for _, key := range tuples {
+		addr, port := parseTupleKey(key)
+		am.lent[am.key(addr, port)] = true
+	}
+}
+
+// QuarantinedTuples returns the released tuples still in quarantine, in
+// release order.
+func (am *AddrManager) QuarantinedTuples() []QuarantinedTuple {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	tuples := []QuarantinedTuple{}
+	for _, released := range am.released {
+		if time.Since(released.released) >= am.Quarantine {
+			continue
+		}
+		if at, ok := am.releasedAt[released.tuple]; ok && at.Equal(released.released) {
+			tuples = append(tuples, QuarantinedTuple{Tuple: released.tuple, Released: released.released})
+		}
+	}
+	return tuples
+}
+
+func (am *AddrManager) RestoreQuarantined(tuples []QuarantinedTuple) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	for _, tuple := range tuples {
+		addr, port := parseTupleKey(tuple.Tuple)
+		key := am.key(addr, port)
+		if am.inUse[key] || am.lent[key] {
+			continue
+		}
+		am.quarantine(key, tuple.Released)
+	}
+}
+
+func (am *AddrManager) Owns(addr net.IP, port uint16) bool {
 	if !am.AddrRange.Contains(addr) {
-		return nil, fmt.Errorf("Insufficient address")
+		return false
+	}
+	return am.PortMax == 0 || (port >= am.PortMin && port <= am.PortMax)
+}
+
+func (am *AddrManager) Stats() AddrStats {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	size, _ := new(big.Float).SetInt(am.size).Float64()
+	// the queue is in release order, so the quarantined tuples are its tail
+	quarantined := 0
+	expired := sort.Search(len(am.released), func(i int) bool {
+		return time.Since(am.released[i].released) < am.Quarantine
+	})
+	for _, released := range am.released[expired:] {
+		if at, ok := am.releasedAt[released.tuple]; ok && at.Equal(released.released) {
+			quarantined++
+		}
+	}
+	return AddrStats{
+		Size:        size,
+		InUse:       len(am.inUse),
+		Lent:        len(am.lent),
+		Quarantined: quarantined,
+		Allocations: am.allocations,
+		Exhaustions: am.exhaustions,
+	}
+}
+
+func (am *AddrManager) tuple(index *big.Int) (net.IP, uint16) {
+	offset, port := new(big.Int).DivMod(index, am.ports, new(big.Int))
+	value := offset.Add(offset, am.first).Add(offset, am.base).Bytes()
+	addr := make(net.IP, len(am.AddrRange.IP))
+	copy(addr[len(addr)-len(value):], value)
+	if am.PortMax == 0 {
+		return addr, 0
+	}
+	return addr, am.PortMin + uint16(port.Int64())
+}
+
+func (am *AddrManager) take(addr net.IP, port uint16) (net.IP, uint16, error) {
+	key := am.key(addr, port)
+	delete(am.releasedAt, key)
+	am.inUse[key] = true
+	am.allocations++
+	return addr, port, nil
+}
+
+// quarantine queues a released tuple. Only its latest release counts, an
+// earlier entry still in the queue is skipped.
+func (am *AddrManager) quarantine(key string, released time.Time) {
+	am.releasedAt[key] = released
+	am.released = append(am.released, releasedTuple{
+		tuple:    key,
+		released: released,
+	})
+}
+
+// key identifies a tuple. Without a port range only the address is
+// allocated and the kernel picks the port, so the port is not part of it.
+func (am *AddrManager) key(addr net.IP, port uint16) string {
+	if am.PortMax == 0 {
+		port = 0
+	}
+	return fmt.Sprintf("[%s]:%d", addr, port)
+}
+
+func parseTupleKey(key string) (net.IP, uint16) {
+	host, port, _ := net.SplitHostPort(key)
+	p, _ := strconv.Atoi(port)
+	ip := net.ParseIP(host)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
 	}
-	return addr, nil
+	return ip, uint16(p)
 }
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestAddrManager(t *testing.T, addrRange string, portRange string, quarantine time.Duration) *AddrManager {
+	am, err := newAddrManager(addrRange, portRange, quarantine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return am
+}
+
+func allocateAll(am *AddrManager) []string {
+	tuples := []string{}
+	for {
+		addr, port, err := am.Allocate()
+		if err != nil {
+			return tuples
+		}
+		tuples = append(tuples, fmt.Sprintf("[%s]:%d", addr, port))
+	}
+}
+
+func TestAllocate(t *testing.T) {
+	tests := []struct {
+		name      string
+		addrRange string
+		portRange string
+		want      []string
+	}{
+		{"address only", "192.0.2.0/30", "", []string{"[192.0.2.1]:0", "[192.0.2.2]:0", "[192.0.2.3]:0"}},
+		{"single address", "192.0.2.1/32", "", []string{"[192.0.2.1]:0"}},
+		{"port range", "fc00::/127", "100-101", []string{"[fc00::1]:100", "[fc00::1]:101"}},
+		{"single port", "192.0.2.0/31", "100-100", []string{"[192.0.2.1]:100"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			am := newTestAddrManager(t, test.addrRange, test.portRange, 0)
+			got := allocateAll(am)
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("allocated %v, want %v", got, test.want)
+			}
+			stats := am.Stats()
+			if stats.InUse != len(test.want) || stats.Allocations != uint64(len(test.want)) || stats.Exhaustions != 1 {
+				t.Errorf("got stats %+v", stats)
+			}
+		})
+	}
+}
+
+func TestNewAddrManagerInvalid(t *testing.T) {
+	tests := []struct {
+		name      string
+		addrRange string
+		portRange string
+	}{
+		{"bad range", "192.0.2.0", ""},
+		{"no bounds", "192.0.2.0/30", "100"},
+		{"reversed", "192.0.2.0/30", "200-100"},
+		{"port zero", "192.0.2.0/30", "0-100"},
+		{"beyond 16 bits", "192.0.2.0/30", "100-65536"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := newAddrManager(test.addrRange, test.portRange, 0); err == nil {
+				t.Error("created invalid address manager")
+			}
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	addr := net.ParseIP("192.0.2.1").To4()
+	tests := []struct {
+		name       string
+		quarantine time.Duration
+		release    func(am *AddrManager)
+		reused     bool
+	}{
+		{
+			name:       "released",
+			quarantine: time.Hour,
+			release:    func(am *AddrManager) { am.Release(addr, 0) },
+		},
+		{
+			name:       "returned",
+			quarantine: time.Hour,
+			release: func(am *AddrManager) {
+				am.Lend(addr, 0)
+				am.Return(addr, 0)
+			},
+		},
+		{
+			name:       "quarantine over",
+			quarantine: time.Nanosecond,
+			release:    func(am *AddrManager) { am.Release(addr, 0) },
+			reused:     true,
+		},
+		{
+			name:       "lent",
+			quarantine: time.Nanosecond,
+			release:    func(am *AddrManager) { am.Lend(addr, 0) },
+		},
+		{
+			name:       "return of a tuple not lent",
+			quarantine: time.Nanosecond,
+			release:    func(am *AddrManager) { am.Return(addr, 0) },
+		},
+		{
+			name:       "reclaimed after release",
+			quarantine: time.Nanosecond,
+			release: func(am *AddrManager) {
+				am.Release(addr, 0)
+				am.Reclaim(addr, 0)
+			},
+		},
+		{
+			// the first queue entry must not end the quarantine of the
+			// second release
+			name:       "released again after reclaim",
+			quarantine: 50 * time.Millisecond,
+			release: func(am *AddrManager) {
+				am.Release(addr, 0)
+				time.Sleep(60 * time.Millisecond)
+				am.Reclaim(addr, 0)
+				am.Release(addr, 0)
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			am := newTestAddrManager(t, "192.0.2.1/32", "", test.quarantine)
+			if got, _, err := am.Allocate(); err != nil || !got.Equal(addr) {
+				t.Fatalf("allocated %s, %v", got, err)
+			}
+			test.release(am)
+			time.Sleep(time.Millisecond)
+			got, _, err := am.Allocate()
+			if test.reused && (err != nil || !got.Equal(addr)) {
+				t.Errorf("allocated %s, %v, want %s", got, err, addr)
+			}
+			if !test.reused && err == nil {
+				t.Errorf("allocated %s, want none", got)
+			}
+		})
+	}
+}
+
+func TestReuseBeforeFresh(t *testing.T) {
+	am := newTestAddrManager(t, "fc00::/64", "", 0)
+	for i := 0; i < 1000; i++ {
+		addr, port, err := am.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		am.Release(addr, port)
+	}
+	if len(am.released) != 1 || am.next.Int64() != 1 {
+		t.Errorf("queued %d released tuples and took %s fresh ones, want 1 and 1", len(am.released), am.next)
+	}
+}
+
+func TestQuarantinedStats(t *testing.T) {
+	am := newTestAddrManager(t, "192.0.2.0/30", "", time.Hour)
+	tuples := []net.IP{}
+	for i := 0; i < 3; i++ {
+		addr, _, err := am.Allocate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tuples = append(tuples, addr)
+	}
+	am.Release(tuples[0], 0)
+	am.Release(tuples[1], 0)
+	am.Reclaim(tuples[1], 0)
+	am.Release(tuples[1], 0)
+	am.Lend(tuples[2], 0)
+	stats := am.Stats()
+	if stats.Quarantined != 2 || stats.InUse != 0 || stats.Lent != 1 {
+		t.Errorf("got stats %+v, want 2 quarantined and 1 lent", stats)
+	}
+}
+
+func TestReclaim(t *testing.T) {
+	am := newTestAddrManager(t, "192.0.2.0/30", "100-199", time.Hour)
+	tests := []struct {
+		name  string
+		addr  string
+		port  uint16
+		owned bool
+	}{
+		{"in range", "192.0.2.2", 150, true},
+		{"address outside", "198.51.100.1", 150, false},
+		{"port outside", "192.0.2.2", 200, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if owned := am.Reclaim(net.ParseIP(test.addr), test.port); owned != test.owned {
+				t.Errorf("reclaimed %t, want %t", owned, test.owned)
+			}
+		})
+	}
+}
+
+func TestReclaimLent(t *testing.T) {
+	am := newTestAddrManager(t, "192.0.2.1/32", "", 0)
+	addr, port, err := am.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	am.Lend(addr, port)
+	if !am.Reclaim(addr, port) {
+		t.Fatal("lent tuple is not owned")
+	}
+	if len(am.LentTuples()) != 0 {
+		t.Errorf("still lent: %v", am.LentTuples())
+	}
+	if _, _, err := am.Allocate(); err == nil {
+		t.Error("allocated a reclaimed tuple")
+	}
+	am.Release(addr, port)
+	if _, _, err := am.Allocate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddressOnlyIgnoresPort(t *testing.T) {
+	am := newTestAddrManager(t, "192.0.2.1/32", "", 0)
+	addr, _, err := am.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the kernel picked the port of the connection
+	am.Release(addr, 40000)
+	if stats := am.Stats(); stats.InUse != 0 {
+		t.Errorf("got stats %+v, want the address released", stats)
+	}
+}
+
+func TestHandOverTuples(t *testing.T) {
+	old := newTestAddrManager(t, "192.0.2.0/30", "", time.Hour)
+	tuples := allocateAll(old)
+	lent, _ := parseTupleKey(tuples[0])
+	released, _ := parseTupleKey(tuples[1])
+	old.Lend(lent, 0)
+	old.Release(released, 0)
+
+	am := newTestAddrManager(t, "192.0.2.0/30", "", time.Hour)
+	am.RestoreLent(old.LentTuples())
+	am.RestoreQuarantined(old.QuarantinedTuples())
+	got := allocateAll(am)
+	if want := tuples[2:]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("allocated %v, want %v", got, want)
+	}
+}
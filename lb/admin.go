@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AdminConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+func newAdmin(config AdminConfig) *Admin {
+	admin := &Admin{
+		config:  config,
+		lbs:     []*lb{},
+		lbMutex: new(sync.Mutex),
+		mux:     http.NewServeMux(),
+	}
+	admin.server = &http.Server{Addr: config.Listen, Handler: admin.mux}
+	admin.mux.HandleFunc("/backends", admin.handleBackends)
+	admin.mux.HandleFunc("/backends/hosts/state", admin.handleHostState)
+	admin.mux.HandleFunc("/peers", admin.handlePeers)
+	admin.mux.HandleFunc("/metrics", admin.handleMetrics)
+	return admin
+}
+
+type Admin struct {
+	config  AdminConfig
+	lbs     []*lb
+	lbMutex *sync.Mutex
+	members *Membership
+	mux     *http.ServeMux
+	server  *http.Server
+}
+
+type adminBackend struct {
+	Name      string     `json:"name"`
+	Scheduler string     `json:"scheduler"`
+	Hosts     []PoolHost `json:"hosts"`
+}
+
+type adminAddrPool struct {
+	labels map[string]string
+	stats  AddrStats
+}
+
+func (admin *Admin) Register(lb *lb) {
+	admin.lbMutex.Lock()
+	defer admin.lbMutex.Unlock()
+	admin.lbs = append(admin.lbs, lb)
+}
+
+func (admin *Admin) SetMembership(members *Membership) {
+	admin.lbMutex.Lock()
+	defer admin.lbMutex.Unlock()
+	admin.members = members
+}
+
+func (admin *Admin) peers() []Peer {
+	admin.lbMutex.Lock()
+	members := admin.members
+	admin.lbMutex.Unlock()
+	if members == nil {
+		return []Peer{}
+	}
+	return members.Peers()
+}
+
+func (admin *Admin) Serve() error {
+	return admin.server.ListenAndServe()
+}
+
+func (admin *Admin) Close() error {
+	return admin.server.Close()
+}
+
+func (admin *Admin) registered() []*lb {
+	admin.lbMutex.Lock()
+	defer admin.lbMutex.Unlock()
+	lbs := make([]*lb, len(admin.lbs))
+	copy(lbs, admin.lbs)
+	return lbs
+}
+
+func (admin *Admin) handleBackends(w http.ResponseWriter, r *http.Request) {
+	backends := []adminBackend{}
+	for _, lb := range admin.registered() {
+		backends = append(backends, adminBackend{
+			Name:      lb.backend.String(),
+			Scheduler: lb.backend.Scheduler,
+			Hosts:     lb.pool.Hosts(),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(backends); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (admin *Admin) handlePeers(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(admin.peers()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (admin *Admin) handleHostState(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	backend := r.FormValue("backend")
+	for _, lb := range admin.registered() {
+		if lb.backend.String() != backend {
+			continue
+		}
+		if err := lb.pool.SetState(r.FormValue("host"), r.FormValue("state")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	http.Error(w, fmt.Sprintf("unknown backend: %s", backend), http.StatusNotFound)
+}
+
+func (admin *Admin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	lbs := admin.registered()
+	pools := []adminAddrPool{}
+	for _, lb := range lbs {
+		pools = append(pools, adminAddrPool{
+			labels: map[string]string{"backend": lb.backend.String(), "range": lb.addrManager.AddrRange.String()},
+			stats:  lb.addrManager.Stats(),
+		})
+	}
+	fmt.Fprintln(w, "# TYPE termlb_address_pool_size gauge")
+	for _, pool := range pools {
+		writeMetric(w, "termlb_address_pool_size", pool.labels, pool.stats.Size)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_address_pool_in_use gauge")
+	for _, pool := range pools {
+		writeMetric(w, "termlb_address_pool_in_use", pool.labels, pool.stats.InUse)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_address_pool_lent gauge")
+	for _, pool := range pools {
+		writeMetric(w, "termlb_address_pool_lent", pool.labels, pool.stats.Lent)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_address_pool_quarantined gauge")
+	for _, pool := range pools {
+		writeMetric(w, "termlb_address_pool_quarantined", pool.labels, pool.stats.Quarantined)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_address_pool_allocations_total counter")
+	for _, pool := range pools {
+		writeMetric(w, "termlb_address_pool_allocations_total", pool.labels, pool.stats.Allocations)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_address_pool_exhausted_total counter")
+	for _, pool := range pools {
+		writeMetric(w, "termlb_address_pool_exhausted_total", pool.labels, pool.stats.Exhaustions)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_backend_host_connections gauge")
+	for _, lb := range lbs {
+		for _, host := range lb.pool.Hosts() {
+			writeMetric(w, "termlb_backend_host_connections", hostMetricLabels(lb, host.Host), host.Conns)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE termlb_backend_host_weight gauge")
+	for _, lb := range lbs {
+		for _, host := range lb.pool.Hosts() {
+			writeMetric(w, "termlb_backend_host_weight", hostMetricLabels(lb, host.Host), host.Weight)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE termlb_backend_host_state gauge")
+	for _, lb := range lbs {
+		for _, host := range lb.pool.Hosts() {
+			for _, state := range []string{HostActive, HostDraining, HostDisabled} {
+				labels := hostMetricLabels(lb, host.Host)
+				labels["state"] = state
+				value := 0
+				if host.State == state {
+					value = 1
+				}
+				writeMetric(w, "termlb_backend_host_state", labels, value)
+			}
+		}
+	}
+	fmt.Fprintln(w, "# TYPE termlb_backend_host_healthy gauge")
+	for _, lb := range lbs {
+		for _, host := range lb.pool.Hosts() {
+			healthy := 0
+			if host.Healthy {
+				healthy = 1
+			}
+			writeMetric(w, "termlb_backend_host_healthy", hostMetricLabels(lb, host.Host), healthy)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE termlb_backend_host_ejected gauge")
+	for _, lb := range lbs {
+		for _, host := range lb.pool.Hosts() {
+			ejected := 0
+			if host.Ejected {
+				ejected = 1
+			}
+			writeMetric(w, "termlb_backend_host_ejected", hostMetricLabels(lb, host.Host), ejected)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE termlb_backend_host_ejections_total counter")
+	for _, lb := range lbs {
+		for _, host := range lb.pool.Hosts() {
+			writeMetric(w, "termlb_backend_host_ejections_total", hostMetricLabels(lb, host.Host), host.Ejections)
+		}
+	}
+	peers := admin.peers()
+	fmt.Fprintln(w, "# TYPE termlb_peer_state gauge")
+	for _, peer := range peers {
+		for _, state := range []string{PeerAlive, PeerSuspect, PeerDead} {
+			value := 0
+			if peer.State == state {
+				value = 1
+			}
+			writeMetric(w, "termlb_peer_state", map[string]string{"node": peer.Node, "state": state}, value)
+		}
+	}
+	fmt.Fprintln(w, "# TYPE termlb_peer_load gauge")
+	for _, peer := range peers {
+		writeMetric(w, "termlb_peer_load", map[string]string{"node": peer.Node}, peer.Load)
+	}
+	fmt.Fprintln(w, "# TYPE termlb_peer_last_seen_seconds gauge")
+	for _, peer := range peers {
+		writeMetric(w, "termlb_peer_last_seen_seconds", map[string]string{"node": peer.Node}, time.Since(peer.LastSeen).Seconds())
+	}
+}
+
+func hostMetricLabels(lb *lb, host Host) map[string]string {
+	labels := map[string]string{}
+	for key, value := range host.Labels {
+		labels[metricLabelName(key)] = value
+	}
+	labels["backend"] = lb.backend.String()
+	labels["host"] = host.String()
+	return labels
+}
+
+func metricLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+func writeMetric(w io.Writer, name string, labels map[string]string, value interface{}) {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%q", key, labels[key])
+	}
+	fmt.Fprintf(w, "%s{%s} %v\n", name, strings.Join(pairs, ","), value)
+}
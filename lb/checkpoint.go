@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+type CheckpointConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type Checkpoint struct {
+	IP         net.IP
+	Port       uint16
+	Owner      string
+	Upstream   TCPRepair
+	Downstream TCPRepair
+	Updated    time.Time
+}
+
+func newCheckpoints(config CheckpointConfig) *Checkpoints {
+	return &Checkpoints{
+		config:  config,
+		entries: map[string]*Checkpoint{},
+		mutex:   new(sync.Mutex),
+	}
+}
+
+type Checkpoints struct {
+	config  CheckpointConfig
+	entries map[string]*Checkpoint
+	mutex   *sync.Mutex
+}
+
+func (cp *Checkpoints) Store(owner net.IP, ip net.IP, port uint16, upstream TCPRepair, downstream TCPRepair) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	cp.entries[fmt.Sprintf("[%s]:%d", ip, port)] = &Checkpoint{
+		IP:         ip,
+		Port:       port,
+		Owner:      owner.String(),
+		Upstream:   upstream,
+		Downstream: downstream,
+		Updated:    time.Now(),
+	}
+}
+
+func (cp *Checkpoints) Forget(owner net.IP, ip net.IP, port uint16) {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	key := fmt.Sprintf("[%s]:%d", ip, port)
+	if entry, ok := cp.entries[key]; ok && (owner == nil || entry.Owner == owner.String()) {
+		delete(cp.entries, key)
+	}
+}
+
+// Expire removes and returns the checkpoints of owners which dead reports
+// as dead.
+func (cp *Checkpoints) Expire(dead func(owner net.IP) bool) []*Checkpoint {
+	cp.mutex.Lock()
+	defer cp.mutex.Unlock()
+	expired := []*Checkpoint{}
+	for key, entry := range cp.entries {
+		if dead(net.ParseIP(entry.Owner)) {
+			// TCP timestamps kept ticking on the owner after the checkpoint,
+			// restoring the captured value would make them go backwards.
+			elapsed := uint32(time.Since(entry.Updated) / time.Millisecond)
+			entry.Upstream.Timestamp += elapsed
+			entry.Downstream.Timestamp += elapsed
+			expired = append(expired, entry)
+			delete(cp.entries, key)
+		}
+	}
+	return expired
+}
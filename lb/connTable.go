@@ -0,0 +1,310 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	errStopped  = fmt.Errorf("pipe is stopped")
+	errMigrated = fmt.Errorf("connection is migrated")
+	errAborted  = fmt.Errorf("restore is aborted")
+)
+
+// aborted restores are remembered this long in case the abort overtakes them
+const abortTimeout = time.Minute
+
+type ProxyConn struct {
+	IP       net.IP `json:"ip"`
+	Port     uint16 `json:"port"`
+	Laddr    net.IP `json:"laddr"`
+	Lport    uint16 `json:"lport"`
+	Daddr    net.IP `json:"daddr"`
+	Dport    uint16 `json:"dport"`
+	Restored bool   `json:"restored"`
+
+	nfd        int
+	cfd        int
+	stop       int
+	host       *PoolHost
+	migrate    chan string
+	result     chan bool
+	done       chan struct{}
+	exit       chan error
+	pipes      sync.WaitGroup
+	pause      sync.RWMutex
+	migrated   int32
+	stopping   int32
+	attempt    uint32
+	checkpoint string
+	closeOnce  sync.Once
+}
+
+func newProxyConn(ip net.IP, port uint16, nfd int, cfd int, host *PoolHost) (*ProxyConn, error) {
+	stop, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &ProxyConn{
+		IP:      ip,
+		Port:    port,
+		nfd:     nfd,
+		cfd:     cfd,
+		stop:    stop,
+		host:    host,
+		migrate: make(chan string, 1),
+		result:  make(chan bool, 1),
+		done:    make(chan struct{}),
+		exit:    make(chan error, 1),
+	}, nil
+}
+
+func (conn *ProxyConn) String() string {
+	return fmt.Sprintf("[%s]:%d", conn.IP, conn.Port)
+}
+
+// Migrate asks to move the connection to node, or to any node when it is
+// empty. It returns false if a migration is already pending.
+func (conn *ProxyConn) Migrate(node string) bool {
+	select {
+	case conn.migrate <- node:
+		return true
+	default:
+		return false
+	}
+}
+
+func (conn *ProxyConn) Stop() {
+	conn.signalStop()
+	conn.pipes.Wait()
+}
+
+// StopTimeout is Stop for a caller which must not hang on a pipe blocked
+// writing to a peer that does not read. The pipe may still be writing when
+// it fails.
+func (conn *ProxyConn) StopTimeout(timeout time.Duration) error {
+	conn.signalStop()
+	stopped := make(chan struct{})
+	go func() {
+		conn.pipes.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out stopping %s", conn)
+	}
+}
+
+func (conn *ProxyConn) signalStop() {
+	atomic.StoreInt32(&conn.stopping, 1)
+	if err := signalEventfd(conn.stop); err != nil {
+		log.Printf("error: %s\n", err)
+	}
+}
+
+func (conn *ProxyConn) relay(src int, dst int, buf []byte) (int, error, error) {
+	conn.pause.RLock()
+	defer conn.pause.RUnlock()
+	if atomic.LoadInt32(&conn.stopping) == 1 {
+		return 0, errStopped, nil
+	}
+	n, err := unix.Read(src, buf)
+	if err != nil || n == 0 {
+		return n, err, nil
+	}
+	return n, nil, writeAll(dst, buf[:n])
+}
+
+// Pause waits until both pipe directions have written out everything they
+// have read, and keeps them from reading more until Resume.
+func (conn *ProxyConn) Pause(timeout time.Duration) error {
+	paused := make(chan struct{})
+	go func() {
+		conn.pause.Lock()
+		close(paused)
+	}()
+	select {
+	case <-paused:
+		return nil
+	case <-time.After(timeout):
+		go func() {
+			<-paused
+			conn.pause.Unlock()
+		}()
+		return fmt.Errorf("timed out pausing %s", conn)
+	}
+}
+
+func (conn *ProxyConn) Resume() {
+	conn.pause.Unlock()
+}
+
+func (conn *ProxyConn) report(ok bool) {
+	select {
+	case conn.result <- ok:
+	default:
+	}
+}
+
+func (conn *ProxyConn) finish(err error) {
+	select {
+	case conn.exit <- err:
+	default:
+	}
+}
+
+func (conn *ProxyConn) Close() {
+	conn.closeOnce.Do(func() {
+		unix.Close(conn.cfd)
+		unix.Close(conn.nfd)
+		unix.Close(conn.stop)
+	})
+}
+
+func newConnTable() *ConnTable {
+	return &ConnTable{
+		conns:   map[string]*ProxyConn{},
+		pending: map[string]*pendingMigration{},
+		aborted: map[abortedRestore]time.Time{},
+		attempt: uint32(time.Now().UnixNano()),
+		mutex:   new(sync.Mutex),
+	}
+}
+
+type ConnTable struct {
+	conns   map[string]*ProxyConn
+	pending map[string]*pendingMigration
+	aborted map[abortedRestore]time.Time
+	attempt uint32
+	mutex   *sync.Mutex
+}
+
+type pendingMigration struct {
+	attempt uint32
+	result  chan bool
+}
+
+// abortedRestore is a migration attempt whose owner gave up before the
+// restored connection was added.
+type abortedRestore struct {
+	flow    string
+	attempt uint32
+}
+
+func (table *ConnTable) Add(conn *ProxyConn) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.conns[conn.String()] = conn
+}
+
+// Admit adds a restored connection unless its owner has aborted the attempt
+// in the meantime.
+func (table *ConnTable) Admit(conn *ProxyConn) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if table.takeAbort(conn.String(), conn.attempt) {
+		return false
+	}
+	table.conns[conn.String()] = conn
+	return true
+}
+
+// Aborted reports whether the owner has given up the attempt to migrate the
+// flow, so it must not be restored.
+func (table *ConnTable) Aborted(ip net.IP, port uint16, attempt uint32) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.takeAbort(fmt.Sprintf("[%s]:%d", ip, port), attempt)
+}
+
+func (table *ConnTable) takeAbort(flow string, attempt uint32) bool {
+	for key, aborted := range table.aborted {
+		if time.Since(aborted) > abortTimeout {
+			delete(table.aborted, key)
+		}
+	}
+	key := abortedRestore{flow: flow, attempt: attempt}
+	if _, ok := table.aborted[key]; !ok {
+		return false
+	}
+	delete(table.aborted, key)
+	return true
+}
+
+// Abort returns the connection restored by the attempt, or remembers the
+// abort for a restore of it still in progress.
+func (table *ConnTable) Abort(ip net.IP, port uint16, attempt uint32) *ProxyConn {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	key := fmt.Sprintf("[%s]:%d", ip, port)
+	if conn, ok := table.conns[key]; ok && conn.Restored && conn.attempt == attempt {
+		return conn
+	}
+	table.aborted[abortedRestore{flow: key, attempt: attempt}] = time.Now()
+	return nil
+}
+
+func (table *ConnTable) Remove(conn *ProxyConn) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	if table.conns[conn.String()] == conn {
+		delete(table.conns, conn.String())
+	}
+}
+
+func (table *ConnTable) Get(ip net.IP, port uint16) *ProxyConn {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	return table.conns[fmt.Sprintf("[%s]:%d", ip, port)]
+}
+
+func (table *ConnTable) List() []*ProxyConn {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	conns := make([]*ProxyConn, 0, len(table.conns))
+	for _, conn := range table.conns {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// Expect starts a new attempt to migrate conn, whose result is delivered by
+// Confirm.
+func (table *ConnTable) Expect(conn *ProxyConn) (uint32, chan bool) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	table.attempt++
+	pending := &pendingMigration{
+		attempt: table.attempt,
+		result:  make(chan bool, 1),
+	}
+	table.pending[conn.String()] = pending
+	return pending.attempt, pending.result
+}
+
+func (table *ConnTable) Confirm(ip net.IP, port uint16, attempt uint32, ok bool) bool {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	key := fmt.Sprintf("[%s]:%d", ip, port)
+	pending, found := table.pending[key]
+	if !found || pending.attempt != attempt {
+		return false
+	}
+	pending.result <- ok
+	delete(table.pending, key)
+	return true
+}
+
+func (table *ConnTable) Forget(conn *ProxyConn) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+	delete(table.pending, conn.String())
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func newTestConn(attempt uint32) *ProxyConn {
+	return &ProxyConn{IP: net.ParseIP("fc00::1"), Port: 40000, Restored: true, attempt: attempt}
+}
+
+func TestAbortBeforeAdmit(t *testing.T) {
+	tests := []struct {
+		name     string
+		aborted  uint32
+		attempt  uint32
+		admitted bool
+	}{
+		{"same attempt", 1, 1, false},
+		{"retry", 1, 2, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := newConnTable()
+			conn := newTestConn(test.attempt)
+			if got := table.Abort(conn.IP, conn.Port, test.aborted); got != nil {
+				t.Fatalf("aborted %s before it was added", got)
+			}
+			if admitted := table.Admit(conn); admitted != test.admitted {
+				t.Errorf("admitted %t, want %t", admitted, test.admitted)
+			}
+			if got := table.Get(conn.IP, conn.Port); (got == conn) != test.admitted {
+				t.Errorf("got %v in the table", got)
+			}
+		})
+	}
+}
+
+func TestAbortAfterAdmit(t *testing.T) {
+	tests := []struct {
+		name    string
+		conn    *ProxyConn
+		attempt uint32
+		found   bool
+	}{
+		{"same attempt", newTestConn(1), 1, true},
+		{"stale attempt", newTestConn(2), 1, false},
+		{"not restored", &ProxyConn{IP: net.ParseIP("fc00::1"), Port: 40000}, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			table := newConnTable()
+			table.Add(test.conn)
+			if got := table.Abort(test.conn.IP, test.conn.Port, test.attempt); (got == test.conn) != test.found {
+				t.Errorf("aborted %v, want found %t", got, test.found)
+			}
+		})
+	}
+}
+
+func TestAbortedConsumed(t *testing.T) {
+	table := newConnTable()
+	conn := newTestConn(1)
+	table.Abort(conn.IP, conn.Port, 1)
+	if table.Aborted(conn.IP, conn.Port, 2) {
+		t.Error("aborted a different attempt")
+	}
+	if !table.Aborted(conn.IP, conn.Port, 1) {
+		t.Error("abort was forgotten")
+	}
+	if table.Aborted(conn.IP, conn.Port, 1) {
+		t.Error("abort was not consumed")
+	}
+	if !table.Admit(conn) {
+		t.Error("consumed abort rejected the conn")
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	table := newConnTable()
+	conn := newTestConn(0)
+	stale, _ := table.Expect(conn)
+	attempt, result := table.Expect(conn)
+	if attempt == stale {
+		t.Fatalf("reused attempt %d", attempt)
+	}
+	if table.Confirm(conn.IP, conn.Port, stale, false) {
+		t.Error("confirmed a stale attempt")
+	}
+	if !table.Confirm(conn.IP, conn.Port, attempt, true) {
+		t.Fatal("did not confirm the attempt")
+	}
+	if ok := <-result; !ok {
+		t.Error("got a failed migration, want it confirmed")
+	}
+	if table.Confirm(conn.IP, conn.Port, attempt, true) {
+		t.Error("confirmed an attempt twice")
+	}
+}
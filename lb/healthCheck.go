@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type HealthCheckConfig struct {
+	Type           string        `yaml:"type"`
+	Interval       time.Duration `yaml:"interval"`
+	Timeout        time.Duration `yaml:"timeout"`
+	Rise           int           `yaml:"rise"`
+	Fall           int           `yaml:"fall"`
+	Path           string        `yaml:"path"`
+	ExpectedStatus int           `yaml:"expectedStatus"`
+	Command        string        `yaml:"command"`
+}
+
+func newHealthChecker(config HealthCheckConfig, pool *HostPool) (*HealthChecker, error) {
+	if config.Interval == 0 {
+		config.Interval = 5 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 2 * time.Second
+	}
+	if config.Rise == 0 {
+		config.Rise = 2
+	}
+	if config.Fall == 0 {
+		config.Fall = 3
+	}
+	if config.Path == "" {
+		config.Path = "/"
+	}
+	if config.ExpectedStatus == 0 {
+		config.ExpectedStatus = http.StatusOK
+	}
+	checker := &HealthChecker{
+		config: config,
+		pool:   pool,
+		counts: map[*PoolHost]int{},
+	}
+	switch config.Type {
+	case "tcp":
+		checker.probe = checker.probeTCP
+	case "http":
+		checker.probe = checker.probeHTTP
+	case "script":
+		checker.probe = checker.probeScript
+	default:
+		return nil, fmt.Errorf("unknown health check type: %s", config.Type)
+	}
+	go func() {
+		for range time.Tick(config.Interval) {
+			checker.check()
+		}
+	}()
+	return checker, nil
+}
+
+type HealthChecker struct {
+	config HealthCheckConfig
+	pool   *HostPool
+	probe  func(host *PoolHost) error
+	counts map[*PoolHost]int
+}
+
+func (checker *HealthChecker) check() {
+	hosts := checker.pool.members()
+	results := make([]error, len(hosts))
+	wg := &sync.WaitGroup{}
+	for i, host := range hosts {
+		wg.Add(1)
+		go func(i int, host *PoolHost) {
+			results[i] = checker.probe(host)
+			wg.Done()
+		}(i, host)
+	}
+	wg.Wait()
+
+	counts := map[*PoolHost]int{}
+	for i, host := range hosts {
+		healthy := checker.pool.Healthy(host)
+		count := checker.counts[host]
+		if (results[i] == nil) == healthy {
+			count = 0
+		} else {
+			count++
+		}
+		switch {
+		case healthy && count >= checker.config.Fall:
+			log.Printf("health check: %s is down: %s\n", host, results[i])
+			checker.pool.SetHealthy(host, false)
+			count = 0
+		case !healthy && count >= checker.config.Rise:
+			log.Printf("health check: %s is up\n", host)
+			checker.pool.SetHealthy(host, true)
+			count = 0
+		}
+		counts[host] = count
+	}
+	checker.counts = counts
+}
+
+func (checker *HealthChecker) probeTCP(host *PoolHost) error {
+	conn, err := net.DialTimeout("tcp", host.String(), checker.config.Timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (checker *HealthChecker) probeHTTP(host *PoolHost) error {
+	client := &http.Client{Timeout: checker.config.Timeout}
+	// Host.String brackets IPv4 addresses too, which is no valid URL host
+	addr := net.JoinHostPort(host.Address.String(), strconv.Itoa(int(host.Port)))
+	res, err := client.Get(fmt.Sprintf("http://%s%s", addr, checker.config.Path))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != checker.config.ExpectedStatus {
+		return fmt.Errorf("unexpected status: %d", res.StatusCode)
+	}
+	return nil
+}
+
+func (checker *HealthChecker) probeScript(host *PoolHost) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checker.config.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", checker.config.Command)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("HOST_ADDRESS=%s", host.Address),
+		fmt.Sprintf("HOST_PORT=%d", host.Port),
+	)
+	return cmd.Run()
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+type Host struct {
+	Address net.IP            `yaml:"address" json:"address"`
+	Port    uint16            `yaml:"port" json:"port"`
+	Weight  int               `yaml:"weight" json:"weight"`
+	Labels  map[string]string `yaml:"labels" json:"labels,omitempty"`
+	State   string            `yaml:"state" json:"state"`
+}
+
+func (host *Host) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address net.IP
+	if err := unmarshal(&address); err == nil {
+		*host = Host{Address: address}
+		return nil
+	}
+	type plain Host
+	return unmarshal((*plain)(host))
+}
+
+func (host Host) String() string {
+	return fmt.Sprintf("[%s]:%d", host.Address, host.Port)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	HostActive   = "active"
+	HostDraining = "draining"
+	HostDisabled = "disabled"
+)
+
+const slowStartScale = 100
+
+type PoolHost struct {
+	Host
+	Conns        int       `json:"conns"`
+	Healthy      bool      `json:"healthy"`
+	Ejected      bool      `json:"ejected"`
+	EjectedUntil time.Time `json:"ejectedUntil"`
+	Ejections    int       `json:"ejections"`
+	ActiveSince  time.Time `json:"activeSince"`
+
+	removed         bool
+	effectiveWeight int
+}
+
+func newHostPool(hosts []Host, port uint16, slowStart time.Duration, scheduler Scheduler) (*HostPool, error) {
+	pool := &HostPool{
+		hosts:     []*PoolHost{},
+		port:      port,
+		slowStart: slowStart,
+		scheduler: scheduler,
+		mutex:     new(sync.Mutex),
+	}
+	for _, host := range hosts {
+		host, err := pool.normalize(host)
+		if err != nil {
+			return nil, err
+		}
+		pool.hosts = append(pool.hosts, &PoolHost{Host: host, Healthy: true})
+	}
+	return pool, nil
+}
+
+type HostPool struct {
+	hosts     []*PoolHost
+	port      uint16
+	slowStart time.Duration
+	scheduler Scheduler
+	mutex     *sync.Mutex
+}
+
+func (pool *HostPool) normalize(host Host) (Host, error) {
+	if host.Port == 0 {
+		host.Port = pool.port
+	}
+	if host.Weight <= 0 {
+		host.Weight = 1
+	}
+	switch host.State {
+	case "":
+		host.State = HostActive
+	case HostActive, HostDraining, HostDisabled:
+	default:
+		return Host{}, fmt.Errorf("unknown host state: %s", host.State)
+	}
+	return host, nil
+}
+
+func (pool *HostPool) Acquire(ip net.IP, port uint16, exclude []*PoolHost) (*PoolHost, error) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if len(pool.hosts) == 0 {
+		return nil, fmt.Errorf("no backend host")
+	}
+	now := time.Now()
+	available := []*PoolHost{}
+	for _, host := range pool.hosts {
+		if host.State == HostActive && host.Healthy && !host.Ejected && !containsHost(exclude, host) {
+			host.effectiveWeight = pool.effectiveWeight(host, now)
+			available = append(available, host)
+		}
+	}
+	if len(available) == 0 {
+		return nil, fmt.Errorf("no available backend host")
+	}
+	host := pool.scheduler.Schedule(available, ip, port)
+	host.Conns++
+	return host, nil
+}
+
+func (pool *HostPool) effectiveWeight(host *PoolHost, now time.Time) int {
+	weight := host.Weight * slowStartScale
+	elapsed := now.Sub(host.ActiveSince)
+	if pool.slowStart == 0 || elapsed >= pool.slowStart {
+		return weight
+	}
+	ramped := int(int64(weight) * int64(elapsed) / int64(pool.slowStart))
+	if ramped < 1 {
+		return 1
+	}
+	return ramped
+}
+
+func (pool *HostPool) Attach(ip net.IP, port uint16) *PoolHost {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, host := range pool.hosts {
+		if host.Address.Equal(ip) && host.Port == port {
+			host.Conns++
+			return host
+		}
+	}
+	return nil
+}
+
+func (pool *HostPool) Release(host *PoolHost) {
+	if host == nil {
+		return
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	host.Conns--
+	if host.State == HostDraining && host.Conns == 0 {
+		log.Printf("host %s is drained\n", host)
+		if host.removed {
+			pool.remove(host)
+		}
+	}
+}
+
+func (pool *HostPool) remove(host *PoolHost) {
+	hosts := []*PoolHost{}
+	for _, h := range pool.hosts {
+		if h != host {
+			hosts = append(hosts, h)
+		}
+	}
+	pool.hosts = hosts
+}
+
+func (pool *HostPool) Update(hosts []Host) error {
+	normalized := make([]Host, len(hosts))
+	for i, host := range hosts {
+		host, err := pool.normalize(host)
+		if err != nil {
+			return err
+		}
+		normalized[i] = host
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	now := time.Now()
+	next := []*PoolHost{}
+	for _, host := range normalized {
+		current := pool.find(host.String())
+		if current == nil {
+			log.Printf("host %s is added\n", host)
+			next = append(next, &PoolHost{Host: host, Healthy: true, ActiveSince: now})
+			continue
+		}
+		if current.State != HostActive && host.State == HostActive {
+			current.ActiveSince = now
+		}
+		if current.State != host.State {
+			log.Printf("host %s is %s\n", host, host.State)
+		}
+		current.Weight = host.Weight
+		current.Labels = host.Labels
+		current.State = host.State
+		current.removed = false
+		next = append(next, current)
+	}
+	for _, host := range pool.hosts {
+		if containsHost(next, host) {
+			continue
+		}
+		if host.Conns == 0 {
+			log.Printf("host %s is removed\n", host)
+			continue
+		}
+		log.Printf("host %s is removed, draining %d connections\n", host, host.Conns)
+		host.State = HostDraining
+		host.removed = true
+		next = append(next, host)
+	}
+	pool.hosts = next
+	return nil
+}
+
+func (pool *HostPool) SetState(name string, state string) error {
+	switch state {
+	case HostActive, HostDraining, HostDisabled:
+	default:
+		return fmt.Errorf("unknown host state: %s", state)
+	}
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	host := pool.find(name)
+	if host == nil || host.removed {
+		return fmt.Errorf("unknown host: %s", name)
+	}
+	if host.State != HostActive && state == HostActive {
+		host.ActiveSince = time.Now()
+	}
+	log.Printf("host %s is %s\n", host, state)
+	host.State = state
+	return nil
+}
+
+func (pool *HostPool) find(name string) *PoolHost {
+	for _, host := range pool.hosts {
+		if host.String() == name {
+			return host
+		}
+	}
+	return nil
+}
+
+func (pool *HostPool) Hosts() []PoolHost {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	hosts := make([]PoolHost, len(pool.hosts))
+	for i, host := range pool.hosts {
+		hosts[i] = *host
+	}
+	return hosts
+}
+
+func (pool *HostPool) members() []*PoolHost {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	hosts := make([]*PoolHost, len(pool.hosts))
+	copy(hosts, pool.hosts)
+	return hosts
+}
+
+func (pool *HostPool) Healthy(host *PoolHost) bool {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return host.Healthy
+}
+
+func (pool *HostPool) SetHealthy(host *PoolHost, healthy bool) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if !host.Healthy && healthy {
+		host.ActiveSince = time.Now()
+	}
+	host.Healthy = healthy
+}
+
+func (pool *HostPool) Ejected(host *PoolHost) (bool, time.Time) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return host.Ejected, host.EjectedUntil
+}
+
+func (pool *HostPool) Eject(host *PoolHost, until time.Time) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	host.Ejected = true
+	host.EjectedUntil = until
+	host.Ejections++
+}
+
+func (pool *HostPool) Reintroduce(host *PoolHost) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	host.Ejected = false
+	host.EjectedUntil = time.Time{}
+	host.ActiveSince = time.Now()
+}
+
+func containsHost(hosts []*PoolHost, host *PoolHost) bool {
+	for _, h := range hosts {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
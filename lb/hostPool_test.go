@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestHostPool(t *testing.T, hosts []Host, slowStart time.Duration) *HostPool {
+	scheduler, err := newScheduler("roundRobin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := newHostPool(hosts, 80, slowStart, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestNewHostPool(t *testing.T) {
+	pool := newTestHostPool(t, []Host{
+		{Address: net.ParseIP("192.0.2.1")},
+		{Address: net.ParseIP("192.0.2.2"), Port: 8080, Weight: 3, State: HostDraining},
+	}, 0)
+	want := []Host{
+		{Address: net.ParseIP("192.0.2.1"), Port: 80, Weight: 1, State: HostActive},
+		{Address: net.ParseIP("192.0.2.2"), Port: 8080, Weight: 3, State: HostDraining},
+	}
+	hosts := pool.Hosts()
+	for i := range want {
+		if got := hosts[i].Host; got.String() != want[i].String() || got.Weight != want[i].Weight || got.State != want[i].State {
+			t.Errorf("got host %+v, want %+v", got, want[i])
+		}
+	}
+	if _, err := newHostPool([]Host{{Address: net.ParseIP("192.0.2.1"), State: "gone"}}, 80, 0, nil); err == nil {
+		t.Error("created pool with unknown host state")
+	}
+}
+
+func TestAcquireAvailable(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(pool *HostPool, host *PoolHost)
+		exclude bool
+	}{
+		{"active", func(pool *HostPool, host *PoolHost) {}, false},
+		{"draining", func(pool *HostPool, host *PoolHost) { pool.SetState(host.String(), HostDraining) }, true},
+		{"disabled", func(pool *HostPool, host *PoolHost) { pool.SetState(host.String(), HostDisabled) }, true},
+		{"unhealthy", func(pool *HostPool, host *PoolHost) { pool.SetHealthy(host, false) }, true},
+		{"ejected", func(pool *HostPool, host *PoolHost) { pool.Eject(host, time.Now().Add(time.Minute)) }, true},
+		{"reintroduced", func(pool *HostPool, host *PoolHost) {
+			pool.Eject(host, time.Now().Add(time.Minute))
+			pool.Reintroduce(host)
+		}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pool := newTestHostPool(t, []Host{{Address: net.ParseIP("192.0.2.1")}}, 0)
+			host := pool.members()[0]
+			test.prepare(pool, host)
+			got, err := pool.Acquire(testClient, 1, nil)
+			if test.exclude && err == nil {
+				t.Errorf("acquired %s", got)
+			}
+			if !test.exclude && got != host {
+				t.Errorf("acquired %s, %v, want %s", got, err, host)
+			}
+		})
+	}
+}
+
+func TestAcquireWeighted(t *testing.T) {
+	pool := newTestHostPool(t, []Host{
+		{Address: net.ParseIP("192.0.2.1"), Weight: 1},
+		{Address: net.ParseIP("192.0.2.2"), Weight: 3},
+	}, 0)
+	counts := map[string]int{}
+	for port := 0; port < 400; port++ {
+		host, err := pool.Acquire(testClient, uint16(port), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[host.String()]++
+	}
+	if counts["[192.0.2.1]:80"] != 100 || counts["[192.0.2.2]:80"] != 300 {
+		t.Errorf("acquired %v, want 100 and 300", counts)
+	}
+	if conns := pool.Hosts()[1].Conns; conns != 300 {
+		t.Errorf("counted %d connections, want 300", conns)
+	}
+}
+
+func TestAcquireExclude(t *testing.T) {
+	pool := newTestHostPool(t, []Host{{Address: net.ParseIP("192.0.2.1")}, {Address: net.ParseIP("192.0.2.2")}}, 0)
+	hosts := pool.members()
+	for i := 0; i < 4; i++ {
+		if got, err := pool.Acquire(testClient, 1, hosts[:1]); err != nil || got != hosts[1] {
+			t.Errorf("acquired %s, %v, want %s", got, err, hosts[1])
+		}
+	}
+	if got, err := pool.Acquire(testClient, 1, hosts); err == nil {
+		t.Errorf("acquired excluded %s", got)
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	pool := newTestHostPool(t, nil, 10*time.Second)
+	now := time.Now()
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    int
+	}{
+		{"just active", 0, 1},
+		{"half way", 5 * time.Second, 2 * slowStartScale},
+		{"done", 10 * time.Second, 4 * slowStartScale},
+		{"never activated", 100 * 365 * 24 * time.Hour, 4 * slowStartScale},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host := &PoolHost{Host: Host{Weight: 4}, ActiveSince: now.Add(-test.elapsed)}
+			if got := pool.effectiveWeight(host, now); got != test.want {
+				t.Errorf("got weight %d, want %d", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpdateDrainsRemovedHosts(t *testing.T) {
+	pool := newTestHostPool(t, []Host{{Address: net.ParseIP("192.0.2.1")}, {Address: net.ParseIP("192.0.2.2")}}, 0)
+	busy := pool.Attach(net.ParseIP("192.0.2.1"), 80)
+	if busy == nil {
+		t.Fatal("attached no host")
+	}
+	if err := pool.Update([]Host{{Address: net.ParseIP("192.0.2.3")}}); err != nil {
+		t.Fatal(err)
+	}
+	hosts := pool.Hosts()
+	if len(hosts) != 2 || hosts[0].String() != "[192.0.2.3]:80" || hosts[1].State != HostDraining {
+		t.Fatalf("got hosts %+v, want the new and the draining one", hosts)
+	}
+	if err := pool.SetState(busy.String(), HostActive); err == nil {
+		t.Error("activated a removed host")
+	}
+	pool.Release(busy)
+	if hosts := pool.Hosts(); len(hosts) != 1 {
+		t.Errorf("got hosts %+v, want the drained one removed", hosts)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+type HotRestartConfig struct {
+	Socket string `yaml:"socket"`
+}
+
+const (
+	handoverListener    = "listener"
+	handoverQuarantined = "quarantined"
+	handoverConn        = "conn"
+	handoverDone        = "done"
+)
+
+// quarantined tuples are sent in batches to fit in a handover message
+const handoverBatch = 256
+
+type handoverMessage struct {
+	Type        string             `json:"type"`
+	Backend     string             `json:"backend,omitempty"`
+	Lent        []string           `json:"lent,omitempty"`
+	Quarantined []QuarantinedTuple `json:"quarantined,omitempty"`
+	Conn        *ProxyConn         `json:"conn,omitempty"`
+}
+
+type inheritedState struct {
+	listener    int
+	lent        []string
+	quarantined []QuarantinedTuple
+	conns       []*ProxyConn
+}
+
+func newHotRestart(config HotRestartConfig) *HotRestart {
+	return &HotRestart{
+		config:  config,
+		lbs:     []*lb{},
+		lbMutex: new(sync.Mutex),
+	}
+}
+
+type HotRestart struct {
+	config  HotRestartConfig
+	lbs     []*lb
+	closers []io.Closer
+	lbMutex *sync.Mutex
+}
+
+func (hr *HotRestart) Register(lb *lb) {
+	hr.lbMutex.Lock()
+	defer hr.lbMutex.Unlock()
+	hr.lbs = append(hr.lbs, lb)
+}
+
+// CloseOnHandover closes c before the new process is told the handover is
+// done, so that it can bind the same addresses.
+func (hr *HotRestart) CloseOnHandover(c io.Closer) {
+	hr.lbMutex.Lock()
+	defer hr.lbMutex.Unlock()
+	hr.closers = append(hr.closers, c)
+}
+
+func (hr *HotRestart) registered() []*lb {
+	hr.lbMutex.Lock()
+	defer hr.lbMutex.Unlock()
+	lbs := make([]*lb, len(hr.lbs))
+	copy(lbs, hr.lbs)
+	return lbs
+}
+
+func (hr *HotRestart) Takeover() (map[string]*inheritedState, error) {
+	inherited := map[string]*inheritedState{}
+	if hr.config.Socket == "" {
+		return inherited, nil
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	if err := unix.Connect(fd, &unix.SockaddrUnix{Name: hr.config.Socket}); err != nil {
+		return inherited, nil
+	}
+	log.Printf("take over from %s\n", hr.config.Socket)
+
+	buf := make([]byte, 65536)
+	oob := make([]byte, unix.CmsgSpace(2*4))
+	done := false
+	for {
+		n, oobn, flags, _, err := unix.Recvmsg(fd, buf, oob, unix.MSG_CMSG_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			break
+		}
+		if flags&(unix.MSG_TRUNC|unix.MSG_CTRUNC) != 0 {
+			return nil, fmt.Errorf("truncated handover message")
+		}
+		fds, err := parseRights(oob[:oobn])
+		if err != nil {
+			return nil, err
+		}
+		msg := handoverMessage{}
+		if err := json.Unmarshal(buf[:n], &msg); err != nil {
+			return nil, err
+		}
+		switch msg.Type {
+		case handoverListener:
+			if len(fds) != 1 {
+				return nil, fmt.Errorf("invalid handover message: %s", buf[:n])
+			}
+			inherited[msg.Backend] = &inheritedState{
+				listener:    fds[0],
+				lent:        msg.Lent,
+				quarantined: []QuarantinedTuple{},
+				conns:       []*ProxyConn{},
+			}
+		case handoverQuarantined:
+			state, ok := inherited[msg.Backend]
+			if !ok || len(fds) != 0 {
+				return nil, fmt.Errorf("invalid handover message: %s", buf[:n])
+			}
+			state.quarantined = append(state.quarantined, msg.Quarantined...)
+		case handoverConn:
+			state, ok := inherited[msg.Backend]
+			if !ok || msg.Conn == nil || len(fds) != 2 {
+				return nil, fmt.Errorf("invalid handover message: %s", buf[:n])
+			}
+			conn, err := newProxyConn(msg.Conn.IP, msg.Conn.Port, fds[0], fds[1], nil)
+			if err != nil {
+				return nil, err
+			}
+			conn.Laddr, conn.Lport = msg.Conn.Laddr, msg.Conn.Lport
+			conn.Daddr, conn.Dport = msg.Conn.Daddr, msg.Conn.Dport
+			conn.Restored = msg.Conn.Restored
+			state.conns = append(state.conns, conn)
+		case handoverDone:
+			done = true
+		default:
+			return nil, fmt.Errorf("unknown handover message: %s", msg.Type)
+		}
+	}
+	if !done {
+		return nil, fmt.Errorf("handover is interrupted")
+	}
+	for backend, state := range inherited {
+		log.Printf("inherit %s with %d connections\n", backend, len(state.conns))
+	}
+	return inherited, nil
+}
+
+func (hr *HotRestart) Serve() error {
+	if err := os.Remove(hr.config.Socket); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_SEQPACKET|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrUnix{Name: hr.config.Socket}); err != nil {
+		return err
+	}
+	if err := unix.Listen(fd, 1); err != nil {
+		return err
+	}
+	nfd, _, err := unix.Accept(fd)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(nfd)
+	log.Println("hand over to new process")
+	return hr.handover(nfd)
+}
+
+func (hr *HotRestart) handover(fd int) error {
+	for _, lb := range hr.registered() {
+		lb.stopAccept()
+		msg := handoverMessage{
+			Type:    handoverListener,
+			Backend: lb.backend.String(),
+			Lent:    lb.addrManager.LentTuples(),
+		}
+		if err := sendHandover(fd, msg, lb.listener); err != nil {
+			return err
+		}
+		quarantined := lb.addrManager.QuarantinedTuples()
+		for len(quarantined) > 0 {
+			n := len(quarantined)
+			if n > handoverBatch {
+				n = handoverBatch
+			}
+			msg := handoverMessage{
+				Type:        handoverQuarantined,
+				Backend:     lb.backend.String(),
+				Quarantined: quarantined[:n],
+			}
+			if err := sendHandover(fd, msg); err != nil {
+				return err
+			}
+			quarantined = quarantined[n:]
+		}
+		for _, conn := range lb.conns.List() {
+			// a pipe still writing would race the new process, such a
+			// connection is left behind and closes with this process
+			if err := conn.StopTimeout(lb.pauseTimeout()); err != nil {
+				log.Printf("warn: %s, not handed over\n", err)
+				continue
+			}
+			msg := handoverMessage{
+				Type:    handoverConn,
+				Backend: lb.backend.String(),
+				Conn:    conn,
+			}
+			if err := sendHandover(fd, msg, conn.nfd, conn.cfd); err != nil {
+				return err
+			}
+		}
+	}
+	hr.lbMutex.Lock()
+	closers := hr.closers
+	hr.lbMutex.Unlock()
+	for _, c := range closers {
+		if err := c.Close(); err != nil {
+			log.Printf("error: %s\n", err)
+		}
+	}
+	return sendHandover(fd, handoverMessage{Type: handoverDone})
+}
+
+func sendHandover(fd int, msg handoverMessage, fds ...int) error {
+	buf, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if len(fds) != 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	return unix.Sendmsg(fd, buf, oob, nil, 0)
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	fds := []int{}
+	for i := range msgs {
+		rights, err := unix.ParseUnixRights(&msgs[i])
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
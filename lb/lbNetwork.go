@@ -1,11 +1,92 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hrntknr/term-lb/wire"
+)
+
+type AuthConfig struct {
+	Keys    []AuthKey     `yaml:"keys"`
+	SendKey uint32        `yaml:"sendKey"`
+	MaxSkew time.Duration `yaml:"maxSkew"`
+	Encrypt bool          `yaml:"encrypt"`
+}
+
+type AuthKey struct {
+	ID     uint32 `yaml:"id"`
+	Secret string `yaml:"secret"`
+	Peer   net.IP `yaml:"peer"`
+}
+
+func newAuthenticator(config AuthConfig) (*wire.Authenticator, error) {
+	if len(config.Keys) == 0 {
+		return nil, nil
+	}
+	if config.MaxSkew == 0 {
+		config.MaxSkew = 30 * time.Second
+	}
+	keys := []wire.Key{}
+	for _, key := range config.Keys {
+		if key.Secret == "" {
+			return nil, fmt.Errorf("empty secret for key %d", key.ID)
+		}
+		keys = append(keys, wire.Key{
+			ID:     key.ID,
+			Secret: []byte(key.Secret),
+			Peer:   key.Peer,
+		})
+	}
+	return wire.NewAuthenticator(keys, config.SendKey, config.MaxSkew, config.Encrypt)
+}
+
+type DeliveryConfig struct {
+	FragmentSize      int           `yaml:"fragmentSize"`
+	RetransmitTimeout time.Duration `yaml:"retransmitTimeout"`
+	MaxRetransmits    int           `yaml:"maxRetransmits"`
+}
+
+// incomplete reassemblies and IDs of delivered messages are kept this long,
+// expired ones are swept at most once per reassemblySweep
+const (
+	reassemblyTimeout = 30 * time.Second
+	reassemblySweep   = time.Second
+)
+
+// limits on incomplete reassemblies, so that a sender cannot exhaust memory
+// with fragments it never completes
+const (
+	maxIncompletePerRemote = 64
+	maxReassemblyBytes     = 128 << 20
 )
 
 func newLBNetwork(config LBNetworkConfig) (*LBNetwork, error) {
+	if config.Delivery.FragmentSize == 0 {
+		config.Delivery.FragmentSize = 1200
+	}
+	if config.Delivery.RetransmitTimeout == 0 {
+		config.Delivery.RetransmitTimeout = 100 * time.Millisecond
+	}
+	if config.Delivery.MaxRetransmits == 0 {
+		config.Delivery.MaxRetransmits = 4
+	}
+	members, err := newMembership(config.Membership)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := newAuthenticator(config.Auth)
+	if err != nil {
+		return nil, err
+	}
 	address, err := net.ResolveUDPAddr("udp", config.Network)
 	if err != nil {
 		return nil, err
@@ -22,45 +103,516 @@ func newLBNetwork(config LBNetworkConfig) (*LBNetwork, error) {
 	if err != nil {
 		return nil, err
 	}
+	peers := []*lbPeer{}
+	for _, address := range config.Peers {
+		peer, err := newLBPeer(source.IP, address)
+		if err != nil {
+			return nil, err
+		}
+		if peer.ip.Equal(source.IP) {
+			peer.udp.Close()
+			continue
+		}
+		peers = append(peers, peer)
+	}
+	var stream *net.TCPListener
+	if len(peers) != 0 {
+		stream, err = net.ListenTCP("tcp", &net.TCPAddr{IP: source.IP, Port: address.Port})
+		if err != nil {
+			return nil, err
+		}
+	}
+	epoch := make([]byte, 4)
+	if _, err := rand.Read(epoch); err != nil {
+		return nil, err
+	}
 	ln := &LBNetwork{
-		config:   config,
-		source:   source.IP,
-		sender:   sender,
-		receiver: receiver,
-		handler:  []func([]byte, net.IP){},
+		config:    config,
+		Members:   members,
+		auth:      auth,
+		source:    source.IP,
+		sender:    sender,
+		receiver:  receiver,
+		stream:    stream,
+		peers:     peers,
+		handler:   []func([]byte, net.IP){},
+		epoch:     binary.BigEndian.Uint32(epoch),
+		pending:   map[uint32]*outgoing{},
+		incoming:  map[string]*incoming{},
+		partial:   map[string]int{},
+		delivered: map[string]time.Time{},
+		mutex:     new(sync.Mutex),
 	}
 	go func() {
-		buffer := make([]byte, 9000)
+		buffer := make([]byte, 65536)
 		for {
 			n, remote, err := ln.receiver.ReadFromUDP(buffer)
 			if err != nil {
+				if atomic.LoadInt32(&ln.closed) == 1 {
+					return
+				}
 				log.Printf("error: %s\n", err)
+				continue
+			}
+			if remote.IP.Equal(ln.source) {
+				continue
+			}
+			buf, ok := ln.open(buffer[:n], remote.IP)
+			if !ok {
+				continue
+			}
+			frame, err := wire.DecodeFrame(buf)
+			if err != nil {
+				log.Printf("warn: drop message from %s: %s\n", remote.IP, err)
+				continue
+			}
+			if frame.Kind == wire.FrameAck {
+				if frame.Epoch == ln.epoch {
+					ln.acked(frame.MsgID, frame.Index, remote.IP)
+				}
+				continue
+			}
+			data, complete, err := ln.reassemble(remote.IP, frame)
+			if err != nil {
+				log.Printf("warn: drop fragment from %s: %s\n", remote.IP, err)
+				continue
 			}
-			if !remote.IP.Equal(ln.source) {
-				buf := make([]byte, n)
-				copy(buf, buffer[:n])
-				for _, handler := range ln.handler {
-					go handler(buf, remote.IP)
+			if frame.Reliable {
+				err := ln.write(&wire.Frame{
+					Kind:  wire.FrameAck,
+					Epoch: frame.Epoch,
+					MsgID: frame.MsgID,
+					Index: frame.Index,
+					Count: frame.Count,
+				})
+				if err != nil {
+					log.Printf("error: %s\n", err)
 				}
 			}
+			if !complete {
+				continue
+			}
+			for _, handler := range ln.handlers() {
+				go handler(data, remote.IP)
+			}
 		}
 	}()
+	if ln.stream != nil {
+		go func() {
+			for {
+				conn, err := ln.stream.Accept()
+				if err != nil {
+					if atomic.LoadInt32(&ln.closed) == 1 {
+						return
+					}
+					log.Printf("error: %s\n", err)
+					continue
+				}
+				go ln.serveStream(conn)
+			}
+		}()
+	}
 	return ln, nil
 }
 
+func (ln *LBNetwork) serveStream(conn net.Conn) {
+	defer conn.Close()
+	remote := conn.RemoteAddr().(*net.TCPAddr).IP
+	if ln.peer(remote) == nil {
+		log.Printf("warn: refuse stream from %s: not a peer\n", remote)
+		return
+	}
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(conn, head); err != nil {
+			if err != io.EOF {
+				log.Printf("error: %s\n", err)
+			}
+			return
+		}
+		n := binary.BigEndian.Uint32(head)
+		if n > maxStreamFrame {
+			log.Printf("warn: close stream from %s: %d byte frame\n", remote, n)
+			return
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			log.Printf("error: %s\n", err)
+			return
+		}
+		data, ok := ln.open(buf, remote)
+		if !ok {
+			continue
+		}
+		for _, handler := range ln.handlers() {
+			go handler(data, remote)
+		}
+	}
+}
+
+func (ln *LBNetwork) peer(ip net.IP) *lbPeer {
+	for _, peer := range ln.peers {
+		if peer.ip.Equal(ip) {
+			return peer
+		}
+	}
+	return nil
+}
+
+// open copies buf out of the receive buffer and authenticates it.
+func (ln *LBNetwork) open(buf []byte, remote net.IP) ([]byte, bool) {
+	buf = append([]byte{}, buf...)
+	if ln.auth == nil {
+		return buf, true
+	}
+	buf, err := ln.auth.Open(buf, remote)
+	if err == wire.ErrUnknownKey && ln.auth.PerPeer() {
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("warn: drop message from %s: %s\n", remote, err)
+		return nil, false
+	}
+	return buf, true
+}
+
+// Close releases the sockets of the LBNetwork, so that another process can
+// take over its addresses.
+func (ln *LBNetwork) Close() error {
+	atomic.StoreInt32(&ln.closed, 1)
+	ln.sender.Close()
+	ln.receiver.Close()
+	if ln.stream != nil {
+		ln.stream.Close()
+	}
+	for _, peer := range ln.peers {
+		peer.Close()
+	}
+	return nil
+}
+
 func (ln *LBNetwork) HandleFunc(handler func([]byte, net.IP)) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
 	ln.handler = append(ln.handler, handler)
 }
 
+func (ln *LBNetwork) handlers() []func([]byte, net.IP) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	handlers := make([]func([]byte, net.IP), len(ln.handler))
+	copy(handlers, ln.handler)
+	return handlers
+}
+
+// Send delivers data to the peers and blocks until every fragment has been
+// acknowledged. On multicast an acknowledgement from any peer is enough.
 func (ln *LBNetwork) Send(data []byte) error {
-	_, err := ln.sender.Write(data)
+	return ln.SendTo(data, nil)
+}
+
+// SendTo is Send for data addressed to the peer at to, only its
+// acknowledgements count. A nil to accepts any peer.
+func (ln *LBNetwork) SendTo(data []byte, to net.IP) error {
+	frames, err := ln.fragment(data, true)
+	if err != nil {
+		return err
+	}
+	msgID := frames[0].MsgID
+	out := &outgoing{
+		to:        to,
+		acked:     make([]bool, len(frames)),
+		remaining: len(frames),
+		done:      make(chan struct{}),
+	}
+	ln.mutex.Lock()
+	ln.pending[msgID] = out
+	ln.mutex.Unlock()
+	defer func() {
+		ln.mutex.Lock()
+		delete(ln.pending, msgID)
+		ln.mutex.Unlock()
+	}()
+
+	timeout := ln.config.Delivery.RetransmitTimeout
+	for attempt := 0; attempt <= ln.config.Delivery.MaxRetransmits; attempt++ {
+		for i, frame := range frames {
+			ln.mutex.Lock()
+			acked := out.acked[i]
+			ln.mutex.Unlock()
+			if acked {
+				continue
+			}
+			if err := ln.write(frame); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-out.done:
+			return nil
+		case <-time.After(timeout):
+		}
+		timeout *= 2
+	}
+	return fmt.Errorf("message %d is not acknowledged", msgID)
+}
+
+// Announce sends data once without waiting for acknowledgements.
+func (ln *LBNetwork) Announce(data []byte) error {
+	frames, err := ln.fragment(data, false)
+	if err != nil {
+		return err
+	}
+	for _, frame := range frames {
+		if err := ln.write(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ln *LBNetwork) SendMessage(msg *wire.Message) error {
+	buf, err := wire.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ln.Send(buf)
+}
+
+func (ln *LBNetwork) SendMessageTo(msg *wire.Message, to net.IP) error {
+	buf, err := wire.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ln.SendTo(buf, to)
+}
+
+func (ln *LBNetwork) AnnounceMessage(msg *wire.Message) error {
+	buf, err := wire.Encode(msg)
+	if err != nil {
+		return err
+	}
+	return ln.Announce(buf)
+}
+
+func (ln *LBNetwork) fragment(data []byte, reliable bool) ([]*wire.Frame, error) {
+	size := ln.config.Delivery.FragmentSize
+	count := (len(data) + size - 1) / size
+	if count == 0 {
+		count = 1
+	}
+	if count > math.MaxUint16 {
+		return nil, fmt.Errorf("message too large: %d bytes", len(data))
+	}
+	msgID := atomic.AddUint32(&ln.msgID, 1)
+	frames := make([]*wire.Frame, count)
+	for i := range frames {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		frames[i] = &wire.Frame{
+			Kind:     wire.FrameData,
+			Reliable: reliable,
+			Epoch:    ln.epoch,
+			MsgID:    msgID,
+			Index:    uint16(i),
+			Count:    uint16(count),
+			Payload:  data[i*size : end],
+		}
+	}
+	return frames, nil
+}
+
+// TransferMessage sends bulk state over the peer streams, falling back to
+// the datagram transport when no peers are configured. A message addressed
+// to a node goes to that node's stream, or over datagrams acknowledged by
+// that node if it is not a configured peer. Otherwise it goes to every peer
+// and succeeds if any of them took it.
+func (ln *LBNetwork) TransferMessage(msg *wire.Message) error {
+	buf, err := wire.Encode(msg)
+	if err != nil {
+		return err
+	}
+	var to net.IP
+	if msg.Node != "" {
+		to = ln.Members.Addr(msg.Node)
+	}
+	if len(ln.peers) == 0 {
+		return ln.SendTo(buf, to)
+	}
+	sealed, err := ln.seal(buf)
+	if err != nil {
+		return err
+	}
+	if msg.Node != "" {
+		if peer := ln.peer(to); peer != nil {
+			return peer.Transfer(sealed)
+		}
+		// the node is not a configured peer, only the datagrams reach it
+		return ln.SendTo(buf, to)
+	}
+	delivered := false
+	for _, peer := range ln.peers {
+		if e := peer.Transfer(sealed); e != nil {
+			log.Printf("error: %s\n", e)
+			err = e
+			continue
+		}
+		delivered = true
+	}
+	if delivered {
+		return nil
+	}
 	return err
 }
 
+func (ln *LBNetwork) seal(buf []byte) ([][]byte, error) {
+	if ln.auth == nil {
+		return [][]byte{buf}, nil
+	}
+	return ln.auth.Seal(buf)
+}
+
+func (ln *LBNetwork) write(frame *wire.Frame) error {
+	sealed, err := ln.seal(wire.EncodeFrame(frame))
+	if err != nil {
+		return err
+	}
+	for _, buf := range sealed {
+		if _, err := ln.sender.Write(buf); err != nil {
+			return err
+		}
+		for _, peer := range ln.peers {
+			if _, err := peer.udp.Write(buf); err != nil {
+				log.Printf("error: %s\n", err)
+			}
+		}
+	}
+	return nil
+}
+
+func (ln *LBNetwork) acked(msgID uint32, index uint16, remote net.IP) {
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	out, ok := ln.pending[msgID]
+	if !ok || int(index) >= len(out.acked) || out.acked[index] {
+		return
+	}
+	if out.to != nil && !out.to.Equal(remote) {
+		return
+	}
+	out.acked[index] = true
+	out.remaining--
+	if out.remaining == 0 {
+		close(out.done)
+	}
+}
+
+// reassemble collects the fragments of a message and returns it once it is
+// complete. Retransmissions of a delivered message are ignored. A fragment
+// which does not fit in the reassembly limits is refused with an error and
+// must not be acknowledged.
+func (ln *LBNetwork) reassemble(remote net.IP, frame *wire.Frame) ([]byte, bool, error) {
+	key := fmt.Sprintf("%s/%d/%d", remote, frame.Epoch, frame.MsgID)
+	ln.mutex.Lock()
+	defer ln.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(ln.swept) > reassemblySweep {
+		ln.swept = now
+		for k, in := range ln.incoming {
+			if now.Sub(in.updated) > reassemblyTimeout {
+				ln.discard(k, in)
+			}
+		}
+		for k, delivered := range ln.delivered {
+			if now.Sub(delivered) > reassemblyTimeout {
+				delete(ln.delivered, k)
+			}
+		}
+	}
+	if _, ok := ln.delivered[key]; ok {
+		return nil, false, nil
+	}
+	in, ok := ln.incoming[key]
+	if !ok {
+		if ln.partial[remote.String()] >= maxIncompletePerRemote {
+			return nil, false, fmt.Errorf("too many incomplete messages")
+		}
+		in = &incoming{
+			remote: remote.String(),
+			frags:  map[uint16][]byte{},
+			count:  frame.Count,
+		}
+		ln.incoming[key] = in
+		ln.partial[in.remote]++
+	}
+	if in.count != frame.Count {
+		return nil, false, fmt.Errorf("inconsistent count %d", frame.Count)
+	}
+	if _, ok := in.frags[frame.Index]; !ok {
+		if ln.buffered+len(frame.Payload) > maxReassemblyBytes {
+			return nil, false, fmt.Errorf("reassembly buffer is full")
+		}
+		in.frags[frame.Index] = append([]byte{}, frame.Payload...)
+		in.size += len(frame.Payload)
+		ln.buffered += len(frame.Payload)
+	}
+	in.updated = now
+	if len(in.frags) != int(in.count) {
+		return nil, false, nil
+	}
+	ln.discard(key, in)
+	ln.delivered[key] = now
+	data := make([]byte, 0, in.size)
+	for i := 0; i < int(in.count); i++ {
+		data = append(data, in.frags[uint16(i)]...)
+	}
+	return data, true, nil
+}
+
+func (ln *LBNetwork) discard(key string, in *incoming) {
+	delete(ln.incoming, key)
+	ln.buffered -= in.size
+	ln.partial[in.remote]--
+	if ln.partial[in.remote] == 0 {
+		delete(ln.partial, in.remote)
+	}
+}
+
+type outgoing struct {
+	to        net.IP
+	acked     []bool
+	remaining int
+	done      chan struct{}
+}
+
+type incoming struct {
+	remote  string
+	frags   map[uint16][]byte
+	count   uint16
+	size    int
+	updated time.Time
+}
+
 type LBNetwork struct {
-	config   LBNetworkConfig
-	source   net.IP
-	sender   *net.UDPConn
-	receiver *net.UDPConn
-	handler  []func([]byte, net.IP)
+	config    LBNetworkConfig
+	Members   *Membership
+	auth      *wire.Authenticator
+	source    net.IP
+	sender    *net.UDPConn
+	receiver  *net.UDPConn
+	stream    *net.TCPListener
+	peers     []*lbPeer
+	handler   []func([]byte, net.IP)
+	epoch     uint32
+	msgID     uint32
+	closed    int32
+	pending   map[uint32]*outgoing
+	incoming  map[string]*incoming
+	partial   map[string]int // incomplete messages per remote
+	buffered  int
+	delivered map[string]time.Time
+	swept     time.Time
+	mutex     *sync.Mutex
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	streamDialTimeout  = 3 * time.Second
+	streamWriteTimeout = 10 * time.Second
+	maxStreamFrame     = 64 << 20
+)
+
+// lbPeer is a unicast peer. Datagrams are sent to it alongside the multicast
+// group, bulk state goes over a TCP stream of length-prefixed frames which is
+// dialed on first use and redialed after an error.
+func newLBPeer(source net.IP, address string) (*lbPeer, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", &net.UDPAddr{IP: source}, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &lbPeer{
+		ip:     udpAddr.IP,
+		source: source,
+		addr:   address,
+		udp:    udp,
+		mutex:  new(sync.Mutex),
+	}, nil
+}
+
+type lbPeer struct {
+	ip     net.IP
+	source net.IP
+	addr   string
+	udp    *net.UDPConn
+	stream net.Conn
+	mutex  *sync.Mutex
+}
+
+func (peer *lbPeer) Transfer(bufs [][]byte) error {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	if peer.stream == nil {
+		dialer := &net.Dialer{
+			LocalAddr: &net.TCPAddr{IP: peer.source},
+			Timeout:   streamDialTimeout,
+		}
+		stream, err := dialer.Dial("tcp", peer.addr)
+		if err != nil {
+			return err
+		}
+		peer.stream = stream
+	}
+	for _, buf := range bufs {
+		frame := make([]byte, 4, 4+len(buf))
+		binary.BigEndian.PutUint32(frame, uint32(len(buf)))
+		frame = append(frame, buf...)
+		peer.stream.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if _, err := peer.stream.Write(frame); err != nil {
+			peer.stream.Close()
+			peer.stream = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (peer *lbPeer) Close() {
+	peer.mutex.Lock()
+	defer peer.mutex.Unlock()
+	peer.udp.Close()
+	if peer.stream != nil {
+		peer.stream.Close()
+		peer.stream = nil
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+)
+
+const maglevTableSize = 65537
+
+const maglevTableCache = 16
+
+type maglevScheduler struct {
+	tables map[string][]*PoolHost
+}
+
+func (s *maglevScheduler) Schedule(hosts []*PoolHost, ip net.IP, port uint16) *PoolHost {
+	names := make([]string, len(hosts))
+	for i, host := range hosts {
+		names[i] = fmt.Sprintf("%p/%s/%d", host, host, host.Weight)
+	}
+	key := strings.Join(names, ",")
+	table, ok := s.tables[key]
+	if !ok {
+		if s.tables == nil || len(s.tables) >= maglevTableCache {
+			s.tables = map[string][]*PoolHost{}
+		}
+		table = maglevPopulate(hosts)
+		s.tables[key] = table
+	}
+	return table[maglevHash("", fmt.Sprintf("[%s]:%d", ip, port))%maglevTableSize]
+}
+
+func maglevPopulate(hosts []*PoolHost) []*PoolHost {
+	sorted := make([]*PoolHost, len(hosts))
+	copy(sorted, hosts)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	offsets := make([]uint64, len(sorted))
+	skips := make([]uint64, len(sorted))
+	maxWeight := 0
+	for i, host := range sorted {
+		offsets[i] = maglevHash("offset", host.String()) % maglevTableSize
+		skips[i] = maglevHash("skip", host.String())%(maglevTableSize-1) + 1
+		if host.Weight > maxWeight {
+			maxWeight = host.Weight
+		}
+	}
+
+	table := make([]*PoolHost, maglevTableSize)
+	next := make([]uint64, len(sorted))
+	credits := make([]int, len(sorted))
+	filled := 0
+	for filled < maglevTableSize {
+		for i, host := range sorted {
+			credits[i] += host.Weight
+			if credits[i] < maxWeight {
+				continue
+			}
+			credits[i] -= maxWeight
+			for {
+				c := (offsets[i] + next[i]*skips[i]) % maglevTableSize
+				next[i]++
+				if table[c] == nil {
+					table[c] = host
+					filled++
+					break
+				}
+			}
+			if filled == maglevTableSize {
+				break
+			}
+		}
+	}
+	return table
+}
+
+func maglevHash(seed string, value string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	h.Write([]byte(value))
+	return h.Sum64()
+}
@@ -1,44 +1,87 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/hrntknr/term-lb/wire"
 	"golang.org/x/sys/unix"
 	"gopkg.in/yaml.v2"
 )
 
+// version is reported to peers in heartbeats, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 var configPath = flag.String("c", "./config.yml", "path of configuration file")
 
 type Config struct {
-	Backends  []Backend       `yaml:"backends"`
-	LBNetwork LBNetworkConfig `yaml:"lbNetwork"`
+	Backends   []Backend        `yaml:"backends"`
+	LBNetwork  LBNetworkConfig  `yaml:"lbNetwork"`
+	Admin      AdminConfig      `yaml:"admin"`
+	HotRestart HotRestartConfig `yaml:"hotRestart"`
 }
 
 type Backend struct {
-	Hosts        []net.IP `yaml:"hosts"`
-	Port         uint16   `yaml:"port"`
-	Listen       uint16   `yaml:"listen"`
-	Vip          net.IP   `yaml:"vip"`
-	Interface    string   `yaml:"interface"`
-	AddressRange string   `yaml:"addressRange"`
+	Hosts        []Host `yaml:"hosts"`
+	Port         uint16 `yaml:"port"`
+	Listen       uint16 `yaml:"listen"`
+	Vip          net.IP `yaml:"vip"`
+	Interface    string `yaml:"interface"`
+	AddressRange string `yaml:"addressRange"`
+	Scheduler    string `yaml:"scheduler"`
+	Family       string `yaml:"family"`
+
+	HealthCheck      HealthCheckConfig      `yaml:"healthCheck"`
+	OutlierDetection OutlierDetectionConfig `yaml:"outlierDetection"`
+	ConnectRetries   int                    `yaml:"connectRetries"`
+	ConnectTimeout   time.Duration          `yaml:"connectTimeout"`
+	SlowStart        time.Duration          `yaml:"slowStart"`
+
+	PortRange         string        `yaml:"portRange"`
+	AddressQuarantine time.Duration `yaml:"addressQuarantine"`
+}
+
+func (backend Backend) String() string {
+	return fmt.Sprintf("[%s]:%d", backend.Vip, backend.Listen)
 }
 
 type LBNetworkConfig struct {
 	Network  string        `yaml:"network"`
 	Source   string        `yaml:"source"`
+	Peers    []string      `yaml:"peers"`
 	Commands CommandConfig `yaml:"commands"`
+
+	EvacuateTimeout  time.Duration    `yaml:"evacuateTimeout"`
+	MigrationTimeout time.Duration    `yaml:"migrationTimeout"`
+	PauseTimeout     time.Duration    `yaml:"pauseTimeout"`
+	Checkpoint       CheckpointConfig `yaml:"checkpoint"`
+	Auth             AuthConfig       `yaml:"auth"`
+	Delivery         DeliveryConfig   `yaml:"delivery"`
+	Membership       MembershipConfig `yaml:"membership"`
+	Lookup           LookupConfig     `yaml:"lookup"`
+}
+
+const (
+	LookupReset = "reset"
+	LookupDrop  = "drop"
+)
+
+type LookupConfig struct {
+	Timeout  time.Duration `yaml:"timeout"`
+	Retries  *int          `yaml:"retries"`
+	Fallback string        `yaml:"fallback"`
 }
 
 type CommandConfig struct {
@@ -51,41 +94,158 @@ func main() {
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	buf, err := ioutil.ReadFile(*configPath)
+	currentConfig, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// every backend is set up before taking over from a running process, so
+	// that a bad configuration exits without disturbing it
+	lbs := []*lb{}
+	for _, backend := range currentConfig.Backends {
+		hook, err := newTCPHook(backend.Interface, backend.Port)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lb, err := newLB(backend, currentConfig, hook)
+		if err != nil {
+			log.Fatal(err)
+		}
+		lbs = append(lbs, lb)
+	}
 
-	var currentConfig Config
-	if err := yaml.Unmarshal(buf, &currentConfig); err != nil {
+	admin := newAdmin(currentConfig.Admin)
+	hotRestart := newHotRestart(currentConfig.HotRestart)
+	inherited, err := hotRestart.Takeover()
+	if err != nil {
 		log.Fatal(err)
 	}
 
-	wg := &sync.WaitGroup{}
-	for _, backend := range currentConfig.Backends {
-		wg.Add(1)
-		go func(backend Backend) {
-			hook, err := newTCPHook(backend.Interface, backend.Port)
-			if err != nil {
+	lbnet, err := newLBNetwork(currentConfig.LBNetwork)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if currentConfig.Admin.Listen != "" {
+		go func() {
+			if err := admin.Serve(); err != nil && err != http.ErrServerClosed {
 				log.Printf("error: %s\n", err)
+			}
+		}()
+	}
+	if currentConfig.HotRestart.Socket != "" {
+		hotRestart.CloseOnHandover(admin)
+		hotRestart.CloseOnHandover(lbnet)
+		go func() {
+			if err := hotRestart.Serve(); err != nil {
+				log.Fatal(err)
+			}
+			os.Exit(0)
+		}()
+	}
+	admin.SetMembership(lbnet.Members)
+	lbnet.HandleFunc(func(buf []byte, remote net.IP) {
+		msg, err := wire.Decode(buf)
+		if err != nil {
+			return
+		}
+		switch msg.Type {
+		case wire.TypeHeartbeat:
+			lbnet.Members.Observe(remote, msg.Heartbeat)
+		case wire.TypeRestore:
+			// refuse a restore addressed to this node which no backend
+			// serves, so that the owner does not wait for its timeout
+			if msg.Node != lbnet.Members.Node() {
 				return
 			}
-
-			lb, err := newLB(backend, currentConfig, hook)
+			for _, lb := range admin.registered() {
+				if lb.serves(msg.Upstream) {
+					return
+				}
+			}
+			log.Printf("warn: no backend serves %s\n", msg)
+			err := lbnet.SendMessageTo(&wire.Message{Type: wire.TypeNack, Flow: msg.Flow, Attempt: msg.Attempt}, remote)
 			if err != nil {
 				log.Printf("error: %s\n", err)
 			}
-			if err := lb.startListen(); err != nil {
+		}
+	})
+	go lbnet.Members.Run(lbnet, func() *wire.Heartbeat {
+		heartbeat := &wire.Heartbeat{VIPs: []net.IP{}}
+		for _, lb := range admin.registered() {
+			if lb.backend.Vip != nil {
+				heartbeat.VIPs = append(heartbeat.VIPs, lb.backend.Vip)
+			}
+			heartbeat.Load += uint32(len(lb.conns.List()))
+		}
+		return heartbeat
+	})
+
+	wg := &sync.WaitGroup{}
+	for i := range lbs {
+		wg.Add(1)
+		go func(lb *lb) {
+			defer wg.Done()
+			lb.inherited = inherited[lb.backend.String()]
+			admin.Register(lb)
+			hotRestart.Register(lb)
+			if err := lb.startListen(lbnet); err != nil {
 				log.Printf("error: %s\n", err)
 			}
-			wg.Done()
-		}(backend)
+		}(lbs[i])
 	}
 	wg.Wait()
 }
 
+func loadConfig(path string) (Config, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	var config Config
+	if err := yaml.Unmarshal(buf, &config); err != nil {
+		return Config{}, err
+	}
+	switch config.LBNetwork.Lookup.Fallback {
+	case "":
+		config.LBNetwork.Lookup.Fallback = LookupReset
+	case LookupReset, LookupDrop:
+	default:
+		return Config{}, fmt.Errorf("unknown lookup fallback: %s", config.LBNetwork.Lookup.Fallback)
+	}
+	return config, nil
+}
+
 func newLB(backend Backend, config Config, hook *TCPHook) (*lb, error) {
-	addrManager, err := newAddrManager(backend.AddressRange)
+	addrManager, err := newAddrManager(backend.AddressRange, backend.PortRange, backend.AddressQuarantine)
+	if err != nil {
+		return nil, err
+	}
+	for _, host := range backend.Hosts {
+		if addressFamily(host.Address) != addressFamily(addrManager.AddrRange.IP) {
+			return nil, fmt.Errorf("host %s does not match the family of %s", host.Address, backend.AddressRange)
+		}
+	}
+	scheduler, err := newScheduler(backend.Scheduler)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := newHostPool(backend.Hosts, backend.Port, backend.SlowStart, scheduler)
+	if err != nil {
+		return nil, err
+	}
+	if backend.HealthCheck.Type != "" {
+		if _, err := newHealthChecker(backend.HealthCheck, pool); err != nil {
+			return nil, err
+		}
+	}
+	var outlier *OutlierDetector
+	if backend.OutlierDetection.ErrorRatio > 0 {
+		outlier = newOutlierDetector(backend.OutlierDetection, pool)
+	}
+	var checkpoints *Checkpoints
+	if config.LBNetwork.Checkpoint.Interval > 0 {
+		checkpoints = newCheckpoints(config.LBNetwork.Checkpoint)
+	}
+	stop, err := unix.Eventfd(0, unix.EFD_CLOEXEC)
 	if err != nil {
 		return nil, err
 	}
@@ -94,6 +254,13 @@ func newLB(backend Backend, config Config, hook *TCPHook) (*lb, error) {
 		config:      config,
 		hook:        hook,
 		addrManager: addrManager,
+		pool:        pool,
+		outlier:     outlier,
+		conns:       newConnTable(),
+		checkpoints: checkpoints,
+		listener:    -1,
+		stop:        stop,
+		accepting:   new(sync.WaitGroup),
 	}, nil
 }
 
@@ -102,385 +269,977 @@ type lb struct {
 	config      Config
 	hook        *TCPHook
 	addrManager *AddrManager
+	pool        *HostPool
+	outlier     *OutlierDetector
+	conns       *ConnTable
+	checkpoints *Checkpoints
+	inherited   *inheritedState
+	listener    int
+	stop        int
+	accepting   *sync.WaitGroup
 }
 
-func (lb *lb) startListen() error {
-	fd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+func (lb *lb) listenFamily() (int, error) {
+	switch lb.backend.Family {
+	case "":
+		return addressFamily(lb.backend.Vip), nil
+	case "ipv4":
+		return unix.AF_INET, nil
+	case "ipv6", "dual":
+		return unix.AF_INET6, nil
+	}
+	return 0, fmt.Errorf("unknown family: %s", lb.backend.Family)
+}
+
+func (lb *lb) listen() (int, error) {
+	family, err := lb.listenFamily()
 	if err != nil {
-		return err
+		return 0, err
 	}
-	var ip [16]byte
-	copy(ip[:], lb.backend.Vip)
-	if err := unix.Bind(fd, &unix.SockaddrInet6{
-		Addr: ip,
-		Port: int(lb.backend.Listen),
-	}); err != nil {
-		return err
+	fd, err := unix.Socket(family, unix.SOCK_STREAM, 0)
+	if err != nil {
+		return 0, err
+	}
+	switch lb.backend.Family {
+	case "ipv6":
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 1)
+	case "dual":
+		err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0)
+	}
+	if err != nil {
+		unix.Close(fd)
+		return 0, err
+	}
+	vip := lb.backend.Vip
+	if vip == nil {
+		vip = net.IPv6zero
+		if family == unix.AF_INET {
+			vip = net.IPv4zero
+		}
+	}
+	lsa, err := sockaddr(family, vip, lb.backend.Listen)
+	if err != nil {
+		unix.Close(fd)
+		return 0, err
+	}
+	if err := unix.Bind(fd, lsa); err != nil {
+		unix.Close(fd)
+		return 0, err
 	}
 	if err := unix.Listen(fd, 1); err != nil {
-		return err
+		unix.Close(fd)
+		return 0, err
 	}
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt)
+	return fd, nil
+}
 
-	lbnet, err := newLBNetwork(lb.config.LBNetwork)
-	if err != nil {
+func (lb *lb) startListen(lbnet *LBNetwork) error {
+	var fd int
+	if lb.inherited != nil {
+		fd = lb.inherited.listener
+		lb.addrManager.RestoreLent(lb.inherited.lent)
+		lb.addrManager.RestoreQuarantined(lb.inherited.quarantined)
+	} else {
+		var err error
+		fd, err = lb.listen()
+		if err != nil {
+			return err
+		}
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
 		return err
 	}
-	rcvLBNet := map[string]chan int{}
-	rcvLBNetMutex := new(sync.Mutex)
+	lb.listener = fd
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt)
+	go lb.watchReload()
+
 	lbnet.HandleFunc(func(buf []byte, remote net.IP) {
-		log.Printf("rcv lbnet: %s\n", buf)
-		commands := strings.Split(string(buf), " ")
-		if len(commands) == 2 {
-			rcvLBNetMutex.Lock()
-			ch, ok := rcvLBNet[fmt.Sprintf("[%s]:%s", commands[0], commands[1])]
-			rcvLBNetMutex.Unlock()
-			if ok {
-				ch <- 0
+		log.Printf("rcv lbnet: %d bytes from %s\n", len(buf), remote)
+		msg, err := wire.Decode(buf)
+		if err != nil {
+			log.Printf("error: %s from %s\n", err, remote)
+			return
+		}
+		switch msg.Type {
+		case wire.TypeRelease:
+			lb.addrManager.Return(msg.Flow.Addr, msg.Flow.Port)
+		case wire.TypeAck, wire.TypeNack:
+			if !lb.conns.Confirm(msg.Flow.Addr, msg.Flow.Port, msg.Attempt, msg.Type == wire.TypeAck) {
+				log.Printf("warn: unexpected %s\n", msg)
+			}
+		case wire.TypeLookup:
+			if conn := lb.conns.Get(msg.Flow.Addr, msg.Flow.Port); conn != nil {
+				if !conn.Migrate(msg.Node) {
+					log.Printf("suppress duplicate lookup for %s from %s\n", conn, msg.Node)
+				}
 			} else {
 				log.Println("not found connection")
 			}
-		}
-		if len(commands) == 4 {
-			log.Println("restore connection")
-			addr := net.ParseIP(commands[0])
-			port, err := strconv.Atoi(commands[1])
-			if err != nil {
-				log.Printf("error: %s\n", err)
-				return
-			}
-			repairUpstream := TCPRepair{}
-			if err := json.Unmarshal([]byte(commands[2]), &repairUpstream); err != nil {
-				log.Printf("error: %s\n", err)
-				return
+		case wire.TypeCheckpoint:
+			if lb.checkpoints != nil && lb.serves(msg.Upstream) {
+				lb.checkpoints.Store(remote, msg.Flow.Addr, msg.Flow.Port, tcpRepairFromWire(msg.Upstream), tcpRepairFromWire(msg.Downstream))
 			}
-
-			nfd, err := lb.repair(lb.backend.Vip, lb.backend.Listen, addr, uint16(port), repairUpstream, false)
-			if err != nil {
-				log.Printf("error: %s\n", err)
-				return
+		case wire.TypeForget:
+			if lb.checkpoints != nil {
+				lb.checkpoints.Forget(remote, msg.Flow.Addr, msg.Flow.Port)
 			}
-			exit := make(chan int, 1)
-			repairDownstream := TCPRepair{}
-			if err := json.Unmarshal([]byte(commands[3]), &repairDownstream); err != nil {
-				log.Printf("error: %s\n", err)
+		case wire.TypeAbort:
+			if msg.Node != "" && msg.Node != lbnet.Members.Node() {
 				return
 			}
-			cfd, err := lb.repair(repairDownstream.Saddr, repairDownstream.Sport, repairDownstream.Daddr, repairDownstream.Dport, repairDownstream, true)
-			if err != nil {
-				log.Printf("error: %s\n", err)
+			lb.abort(msg.Flow.Addr, msg.Flow.Port, msg.Attempt)
+		case wire.TypeRestore:
+			if msg.Node != "" && msg.Node != lbnet.Members.Node() || !lb.serves(msg.Upstream) {
 				return
 			}
-			defer unix.Close(cfd)
-			defer unix.Close(nfd)
-			go func() {
-				cmd := fmt.Sprintf(lb.config.LBNetwork.Commands.Active, repairDownstream.Saddr)
-				log.Printf("exec: %s\n", cmd)
-				err := exec.Command("sh", "-c", cmd).Run()
-				if err != nil {
-					log.Printf("warn: %s\n", err)
-				}
-			}()
-
-			lb.pipe(nfd, cfd, exit)
-
-			go func() {
-				ch := make(chan int)
-				rcvLBNetMutex.Lock()
-				rcvLBNet[fmt.Sprintf("[%s]:%d", addr, port)] = ch
-				rcvLBNetMutex.Unlock()
-				defer unix.Close(cfd)
-				defer unix.Close(nfd)
-				<-ch
-				go func() {
-					cmd := fmt.Sprintf(lb.config.LBNetwork.Commands.Standby, repairDownstream.Saddr)
-					log.Printf("exec: %s\n", cmd)
-					err := exec.Command("sh", "-c", cmd).Run()
-					if err != nil {
-						log.Printf("error: %s\n", err)
-					}
-				}()
-				upstream, downstream, err := lb.createRepairInfo(nfd, cfd)
-				if err != nil {
-					log.Printf("error: %s\n", err)
-					return
-				}
-				upstreamJSON, err := json.Marshal(upstream)
-				if err != nil {
-					log.Printf("error: %s\n", err)
-					return
-				}
-				downstreamJSON, err := json.Marshal(downstream)
-				if err != nil {
-					log.Printf("error: %s\n", err)
-					return
-				}
-				lbnet.Send([]byte(fmt.Sprintf("%s %d %s %s", addr, port, upstreamJSON, downstreamJSON)))
-				rcvLBNetMutex.Lock()
-				delete(rcvLBNet, fmt.Sprintf("[%s]:%d", addr, port))
-				rcvLBNetMutex.Unlock()
-				lb.hook.CloseEvent(addr, uint16(port), time.Second)
-			}()
-
-			<-exit
+			log.Println("restore connection")
+			lb.restore(msg.Flow.Addr, msg.Flow.Port, tcpRepairFromWire(msg.Upstream), tcpRepairFromWire(msg.Downstream), remote, msg.Attempt, lbnet)
 		}
 	})
 	lb.hook.HandleFunc(func(ip net.IP, port uint16) {
-		log.Printf("search lbnet: [%s]:%d\n", ip, port)
-		err := lbnet.Send([]byte(fmt.Sprintf("%s %d", ip, port)))
-		if err != nil {
-			log.Printf("error: %s\n", err)
-		}
+		go lb.lookup(ip, port, lbnet)
 	})
 
+	if lb.inherited != nil {
+		for _, conn := range lb.inherited.conns {
+			lb.hook.AcceptEvent(conn.IP, conn.Port)
+			conn.host = lb.pool.Attach(conn.Daddr, conn.Dport)
+			owned := lb.addrManager.Reclaim(conn.Laddr, conn.Lport)
+			lb.conns.Add(conn)
+			go lb.serve(conn, lbnet, owned)
+		}
+	}
+
+	if lb.checkpoints != nil {
+		go lb.checkpointLoop(lbnet)
+	}
+
+	lb.accepting.Add(100)
 	for i := 0; i < 100; i++ {
 		go func() {
+			defer lb.accepting.Done()
 			for {
+				readable, err := waitReadable(fd, lb.stop)
+				if err != nil {
+					log.Printf("error: %s\n", err)
+					return
+				}
+				if !readable {
+					return
+				}
 				nfd, sa, err := unix.Accept(fd)
+				if err == unix.EAGAIN {
+					continue
+				}
 				if err != nil {
 					log.Printf("error: %s\n", err)
+					continue
 				}
-				exit := make(chan int, 1)
-				sa6 := sa.(*unix.SockaddrInet6)
-				ip := net.IP(sa6.Addr[:])
-				go lb.hook.AcceptEvent(ip, uint16(sa6.Port))
+				ip, cport, err := sockaddrIP(sa)
+				if err != nil {
+					log.Printf("error: %s\n", err)
+					unix.Close(nfd)
+					continue
+				}
+				go lb.hook.AcceptEvent(ip, cport)
 
 				go func() {
-					defer unix.Close(nfd)
-					cfd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+					down, err := lb.connectBackend(ip, cport)
 					if err != nil {
 						log.Printf("error: %s\n", err)
+						unix.Close(nfd)
 						return
 					}
-					if err := unix.SetsockoptInt(cfd, unix.SOL_IP, unix.IP_FREEBIND, 1); err != nil {
-						log.Printf("error: %s\n", err)
-						return
-					}
-					laddr, err := lb.addrManager.releaseIP()
+					conn, err := newProxyConn(ip, cport, nfd, down.fd, down.host)
 					if err != nil {
 						log.Printf("error: %s\n", err)
+						unix.Close(down.fd)
+						unix.Close(nfd)
+						lb.pool.Release(down.host)
+						lb.addrManager.Release(down.laddr, down.lport)
 						return
 					}
-					log.Printf("use %s to downstream\n", laddr)
-					var addr [16]byte
-					copy(addr[:], laddr)
-					if err := unix.Bind(cfd, &unix.SockaddrInet6{
-						Addr: addr,
-					}); err != nil {
-						log.Printf("error: %s\n", err)
-						return
-					}
-					var host [16]byte
-					copy(host[:], lb.backend.Hosts[0])
-					if err := unix.Connect(cfd, &unix.SockaddrInet6{
-						Addr: host,
-						Port: int(lb.backend.Port),
-					}); err != nil {
-						log.Printf("error: %s\n", err)
-						return
-					}
-					defer unix.Close(cfd)
-					lb.pipe(nfd, cfd, exit)
-
-					go func() {
-						ch := make(chan int)
-						rcvLBNetMutex.Lock()
-						rcvLBNet[fmt.Sprintf("[%s]:%d", ip, sa6.Port)] = ch
-						rcvLBNetMutex.Unlock()
-						defer unix.Close(cfd)
-						defer unix.Close(nfd)
-						<-ch
-						log.Printf("rcv ch: [%s]:%d", ip, sa6.Port)
-						upstream, downstream, err := lb.createRepairInfo(nfd, cfd)
-						if err != nil {
-							log.Printf("error: %s\n", err)
-							return
-						}
-						upstreamJSON, err := json.Marshal(upstream)
-						if err != nil {
-							log.Printf("error: %s\n", err)
-							return
-						}
-						downstreamJSON, err := json.Marshal(downstream)
-						if err != nil {
-							log.Printf("error: %s\n", err)
-							return
-						}
-						lbnet.Send([]byte(fmt.Sprintf("%s %d %s %s", ip, sa6.Port, upstreamJSON, downstreamJSON)))
-						rcvLBNetMutex.Lock()
-						delete(rcvLBNet, fmt.Sprintf("[%s]:%d", ip, sa6.Port))
-						rcvLBNetMutex.Unlock()
-						lb.hook.CloseEvent(ip, uint16(sa6.Port), time.Second)
-					}()
-
-					<-exit
-					lb.hook.CloseEvent(ip, uint16(sa6.Port), 1*time.Second)
+					conn.Laddr, conn.Lport = down.laddr, down.lport
+					conn.Daddr, conn.Dport = down.host.Address, down.host.Port
+					lb.conns.Add(conn)
+					lb.serve(conn, lbnet, true)
 				}()
 			}
 		}()
 	}
 	<-quit
+	lb.stopAccept()
+	lb.evacuate(lbnet)
 	unix.Close(fd)
 	return nil
 }
 
+// serves reports whether the client side of a connection belongs to this
+// backend, since every backend shares the LBNetwork.
+func (lb *lb) serves(upstream *wire.Repair) bool {
+	if upstream.Sport != lb.backend.Listen {
+		return false
+	}
+	return lb.backend.Vip == nil || lb.backend.Vip.Equal(upstream.Saddr)
+}
+
+// lookup asks the peers for the owner of an unknown flow until it has been
+// restored, then gives up according to the fallback policy.
+func (lb *lb) lookup(ip net.IP, port uint16, lbnet *LBNetwork) {
+	config := lb.config.LBNetwork.Lookup
+	if config.Timeout == 0 {
+		config.Timeout = time.Second
+	}
+	retries := 2
+	if config.Retries != nil {
+		retries = *config.Retries
+	}
+	for attempt := 0; attempt <= retries; attempt++ {
+		log.Printf("search lbnet: [%s]:%d\n", ip, port)
+		err := lbnet.AnnounceMessage(&wire.Message{
+			Type: wire.TypeLookup,
+			Flow: wire.Flow{Addr: ip, Port: port},
+			Node: lbnet.Members.Node(),
+		})
+		if err != nil {
+			log.Printf("error: %s\n", err)
+		}
+		time.Sleep(config.Timeout)
+		if !lb.hook.Pending(ip, port) {
+			return
+		}
+	}
+	log.Printf("no owner for [%s]:%d, fallback: %s\n", ip, port, config.Fallback)
+	if config.Fallback == LookupReset {
+		if err := lb.hook.Reset(ip, port); err != nil {
+			log.Printf("error: %s\n", err)
+		}
+	}
+	lb.hook.Forget(ip, port)
+}
+
+// restore takes over a connection from origin, the LB which sent its state
+// in the migration attempt. origin is nil when taking over from a dead LB.
+func (lb *lb) restore(addr net.IP, port uint16, repairUpstream TCPRepair, repairDownstream TCPRepair, origin net.IP, attempt uint32, lbnet *LBNetwork) {
+	nack := func() {
+		err := lbnet.SendMessageTo(&wire.Message{Type: wire.TypeNack, Flow: wire.Flow{Addr: addr, Port: port}, Attempt: attempt}, origin)
+		if err != nil {
+			log.Printf("error: %s\n", err)
+		}
+	}
+	if lb.conns.Aborted(addr, port, attempt) {
+		log.Printf("restore of [%s]:%d is aborted\n", addr, port)
+		nack()
+		return
+	}
+	conn, err := lb.restoreConn(addr, port, repairUpstream, repairDownstream)
+	if err != nil {
+		log.Printf("error: %s\n", err)
+		nack()
+		return
+	}
+	conn.attempt = attempt
+	// the abort may have arrived while the sockets were repaired
+	if !lb.conns.Admit(conn) {
+		log.Printf("restore of %s is aborted\n", conn)
+		if err := freeze(conn); err != nil {
+			log.Printf("error: %s\n", err)
+		}
+		conn.Close()
+		nack()
+		return
+	}
+	lb.hook.AcceptEvent(addr, port)
+	conn.host = lb.pool.Attach(conn.Daddr, conn.Dport)
+	owned := lb.addrManager.Reclaim(conn.Laddr, conn.Lport)
+	if lb.checkpoints != nil {
+		lb.checkpoints.Forget(nil, addr, port)
+	}
+	go func() {
+		cmd := fmt.Sprintf(lb.config.LBNetwork.Commands.Active, conn.Laddr)
+		log.Printf("exec: %s\n", cmd)
+		err := exec.Command("sh", "-c", cmd).Run()
+		if err != nil {
+			log.Printf("warn: %s\n", err)
+		}
+	}()
+	if err := lbnet.SendMessageTo(&wire.Message{Type: wire.TypeAck, Flow: wire.Flow{Addr: addr, Port: port}, Attempt: attempt}, origin); err != nil {
+		log.Printf("error: %s\n", err)
+	}
+	lb.serve(conn, lbnet, owned)
+}
+
+func (lb *lb) restoreConn(addr net.IP, port uint16, repairUpstream TCPRepair, repairDownstream TCPRepair) (*ProxyConn, error) {
+	vip, listen := lb.backend.Vip, lb.backend.Listen
+	if repairUpstream.Saddr != nil {
+		vip, listen = repairUpstream.Saddr, repairUpstream.Sport
+	}
+	nfd, err := lb.repair(vip, listen, addr, port, repairUpstream, false)
+	if err != nil {
+		return nil, err
+	}
+	cfd, err := lb.repair(repairDownstream.Saddr, repairDownstream.Sport, repairDownstream.Daddr, repairDownstream.Dport, repairDownstream, true)
+	if err != nil {
+		unix.Close(nfd)
+		return nil, err
+	}
+	conn, err := newProxyConn(addr, port, nfd, cfd, nil)
+	if err != nil {
+		unix.Close(cfd)
+		unix.Close(nfd)
+		return nil, err
+	}
+	conn.Laddr, conn.Lport = repairDownstream.Saddr, repairDownstream.Sport
+	conn.Daddr, conn.Dport = repairDownstream.Daddr, repairDownstream.Dport
+	conn.Restored = true
+	return conn, nil
+}
+
+func (lb *lb) checkpointLoop(lbnet *LBNetwork) {
+	for range time.Tick(lb.config.LBNetwork.Checkpoint.Interval) {
+		for _, conn := range lb.conns.List() {
+			upstream, downstream, err := lb.snapshot(conn)
+			if err != nil {
+				log.Printf("error: %s\n", err)
+				continue
+			}
+			seqs := fmt.Sprintf("%d %d %d %d", upstream.SndSeq, upstream.RcvSeq, downstream.SndSeq, downstream.RcvSeq)
+			if seqs == conn.checkpoint {
+				continue
+			}
+			msg := &wire.Message{
+				Type:       wire.TypeCheckpoint,
+				Flow:       wire.Flow{Addr: conn.IP, Port: conn.Port},
+				Upstream:   upstream.wire(),
+				Downstream: downstream.wire(),
+			}
+			if err := lbnet.TransferMessage(msg); err != nil {
+				log.Printf("error: %s\n", err)
+				continue
+			}
+			conn.checkpoint = seqs
+		}
+		for _, checkpoint := range lb.checkpoints.Expire(lbnet.Members.Dead) {
+			if !lbnet.Members.Coordinator() {
+				continue
+			}
+			log.Printf("owner %s is dead, take over [%s]:%d\n", checkpoint.Owner, checkpoint.IP, checkpoint.Port)
+			lb.hook.AcceptEvent(checkpoint.IP, checkpoint.Port)
+			go lb.restore(checkpoint.IP, checkpoint.Port, checkpoint.Upstream, checkpoint.Downstream, nil, 0, lbnet)
+		}
+	}
+}
+
+// snapshot dumps the repair state of a live connection without tearing it
+// down. Anything exchanged after the snapshot is not covered, so a takeover
+// from it is only exact for connections that stayed idle since.
+func (lb *lb) snapshot(conn *ProxyConn) (TCPRepair, TCPRepair, error) {
+	if err := conn.Pause(lb.pauseTimeout()); err != nil {
+		return TCPRepair{}, TCPRepair{}, err
+	}
+	defer conn.Resume()
+	upstream, downstream, err := lb.createRepairInfo(conn.nfd, conn.cfd, conn.Daddr, conn.Dport)
+	if uerr := unfreeze(conn); uerr != nil && err == nil {
+		err = uerr
+	}
+	return upstream, downstream, err
+}
+
+func (lb *lb) pauseTimeout() time.Duration {
+	if lb.config.LBNetwork.PauseTimeout == 0 {
+		return time.Second
+	}
+	return lb.config.LBNetwork.PauseTimeout
+}
+
+// freeze puts both sockets into repair mode, so closing them does not
+// disturb the peers which are now served by another LB.
+func freeze(conn *ProxyConn) error {
+	var err error
+	for _, fd := range []int{conn.nfd, conn.cfd} {
+		if rerr := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_REPAIR, 1); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// abort drops a restored connection whose owner rolled the migration attempt
+// back.
+func (lb *lb) abort(addr net.IP, port uint16, attempt uint32) {
+	conn := lb.conns.Abort(addr, port, attempt)
+	if conn == nil {
+		return
+	}
+	log.Printf("abort restored %s\n", conn)
+	if err := conn.Pause(lb.pauseTimeout()); err != nil {
+		log.Printf("warn: %s\n", err)
+	} else {
+		defer conn.Resume()
+	}
+	if err := freeze(conn); err != nil {
+		log.Printf("error: %s\n", err)
+	}
+	atomic.StoreInt32(&conn.migrated, 1)
+	conn.finish(errAborted)
+}
+
+func unfreeze(conn *ProxyConn) error {
+	var err error
+	for _, fd := range []int{conn.nfd, conn.cfd} {
+		if rerr := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_REPAIR, 0); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+func (lb *lb) stopAccept() {
+	if err := signalEventfd(lb.stop); err != nil {
+		log.Printf("error: %s\n", err)
+	}
+	lb.accepting.Wait()
+}
+
+func (lb *lb) serve(conn *ProxyConn, lbnet *LBNetwork, owned bool) {
+	defer conn.Close()
+	defer lb.pool.Release(conn.host)
+	defer func() {
+		switch {
+		case atomic.LoadInt32(&conn.migrated) == 1:
+			if owned {
+				lb.addrManager.Lend(conn.Laddr, conn.Lport)
+			}
+		case owned:
+			lb.addrManager.Release(conn.Laddr, conn.Lport)
+		default:
+			// only the LB which lent the tuple takes it back
+			if err := lbnet.SendMessage(&wire.Message{Type: wire.TypeRelease, Flow: wire.Flow{Addr: conn.Laddr, Port: conn.Lport}}); err != nil {
+				log.Printf("error: %s\n", err)
+			}
+		}
+	}()
+	if lb.checkpoints != nil {
+		defer func() {
+			if err := lbnet.SendMessage(&wire.Message{Type: wire.TypeForget, Flow: wire.Flow{Addr: conn.IP, Port: conn.Port}}); err != nil {
+				log.Printf("error: %s\n", err)
+			}
+		}()
+	}
+	connected := time.Now()
+	defer lb.conns.Remove(conn)
+	defer close(conn.done)
+	lb.pipe(conn)
+	go lb.waitMigration(conn, lbnet)
+
+	err := <-conn.exit
+	conn.Stop()
+	if err, ok := err.(*downstreamError); ok && err.err == unix.ECONNRESET && conn.host != nil {
+		lb.outlier.ReportReset(conn.host, time.Since(connected))
+	}
+	lb.hook.CloseEvent(conn.IP, conn.Port, 1*time.Second)
+}
+
+func (lb *lb) waitMigration(conn *ProxyConn, lbnet *LBNetwork) {
+	for {
+		var node string
+		select {
+		case node = <-conn.migrate:
+		case <-conn.done:
+			return
+		}
+		committed := lb.migrate(conn, node, lbnet)
+		conn.report(committed)
+		if committed {
+			return
+		}
+	}
+}
+
+func (lb *lb) migrate(conn *ProxyConn, node string, lbnet *LBNetwork) bool {
+	log.Printf("migrate %s to %q\n", conn, node)
+	if err := conn.Pause(lb.pauseTimeout()); err != nil {
+		log.Printf("warn: %s\n", err)
+		return false
+	}
+	defer conn.Resume()
+	attempt, confirmation := lb.conns.Expect(conn)
+	defer lb.conns.Forget(conn)
+
+	rollback := func(err error) bool {
+		log.Printf("error: %s\n", err)
+		log.Printf("rollback migration of %s\n", conn)
+		if err := unfreeze(conn); err != nil {
+			log.Printf("error: %s\n", err)
+			conn.finish(err)
+		}
+		return false
+	}
+	upstream, downstream, err := lb.createRepairInfo(conn.nfd, conn.cfd, conn.Daddr, conn.Dport)
+	if err != nil {
+		return rollback(err)
+	}
+	msg := &wire.Message{
+		Type:       wire.TypeRestore,
+		Flow:       wire.Flow{Addr: conn.IP, Port: conn.Port},
+		Node:       node,
+		Attempt:    attempt,
+		Upstream:   upstream.wire(),
+		Downstream: downstream.wire(),
+	}
+	if err := lbnet.TransferMessage(msg); err != nil {
+		return rollback(err)
+	}
+	timeout := lb.config.LBNetwork.MigrationTimeout
+	if timeout == 0 {
+		timeout = 3 * time.Second
+	}
+	select {
+	case ok := <-confirmation:
+		if !ok {
+			return rollback(fmt.Errorf("peer failed to restore %s", conn))
+		}
+	case <-time.After(timeout):
+		// the peer may have restored the connection and lost its ack, it
+		// must drop its copy before this one goes on.
+		err := lbnet.SendMessageTo(&wire.Message{
+			Type:    wire.TypeAbort,
+			Flow:    wire.Flow{Addr: conn.IP, Port: conn.Port},
+			Node:    node,
+			Attempt: attempt,
+		}, lbnet.Members.Addr(node))
+		if err != nil {
+			log.Printf("error: %s\n", err)
+		}
+		return rollback(fmt.Errorf("no acknowledgement for %s", conn))
+	}
+
+	log.Printf("commit migration of %s\n", conn)
+	if conn.Restored {
+		go func() {
+			cmd := fmt.Sprintf(lb.config.LBNetwork.Commands.Standby, conn.Laddr)
+			log.Printf("exec: %s\n", cmd)
+			err := exec.Command("sh", "-c", cmd).Run()
+			if err != nil {
+				log.Printf("error: %s\n", err)
+			}
+		}()
+	}
+	atomic.StoreInt32(&conn.migrated, 1)
+	conn.finish(errMigrated)
+	return true
+}
+
+func (lb *lb) evacuate(lbnet *LBNetwork) {
+	if lb.backend.Vip != nil && lb.config.LBNetwork.Commands.Standby != "" {
+		cmd := fmt.Sprintf(lb.config.LBNetwork.Commands.Standby, lb.backend.Vip)
+		log.Printf("exec: %s\n", cmd)
+		if err := exec.Command("sh", "-c", cmd).Run(); err != nil {
+			log.Printf("warn: %s\n", err)
+		}
+	}
+	conns := lb.conns.List()
+	if len(conns) == 0 {
+		return
+	}
+	node := lbnet.Members.Pick(lb.backend.Vip)
+	log.Printf("evacuate %d connections to %q\n", len(conns), node)
+	for _, conn := range conns {
+		select {
+		case <-conn.result:
+		default:
+		}
+		conn.Migrate(node)
+	}
+	timeout := lb.config.LBNetwork.EvacuateTimeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	deadline := time.After(timeout)
+	evacuated := 0
+	for _, conn := range conns {
+		select {
+		case ok := <-conn.result:
+			if ok {
+				evacuated++
+			}
+		case <-deadline:
+			log.Printf("warn: evacuation timed out, %d/%d connections evacuated\n", evacuated, len(conns))
+			return
+		}
+	}
+	if evacuated != len(conns) {
+		log.Printf("warn: %d/%d connections evacuated\n", evacuated, len(conns))
+		return
+	}
+	log.Printf("evacuated %d connections\n", len(conns))
+}
+
+func (lb *lb) watchReload() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		config, err := loadConfig(*configPath)
+		if err != nil {
+			log.Printf("error: %s\n", err)
+			continue
+		}
+		for _, backend := range config.Backends {
+			if backend.String() != lb.backend.String() {
+				continue
+			}
+			log.Printf("reload %s\n", backend)
+			if err := lb.pool.Update(backend.Hosts); err != nil {
+				log.Printf("error: %s\n", err)
+			}
+		}
+	}
+}
+
+type downstreamConn struct {
+	fd    int
+	host  *PoolHost
+	laddr net.IP
+	lport uint16
+}
+
+func (lb *lb) connectBackend(ip net.IP, port uint16) (*downstreamConn, error) {
+	tried := []*PoolHost{}
+	var lastErr error
+	for attempt := 0; attempt <= lb.backend.ConnectRetries; attempt++ {
+		host, err := lb.pool.Acquire(ip, port, tried)
+		if err != nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, err
+		}
+		tried = append(tried, host)
+		down, err := lb.dialBackend(host)
+		if err == nil {
+			return down, nil
+		}
+		lb.pool.Release(host)
+		log.Printf("warn: connect to %s failed: %s\n", host, err)
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (lb *lb) dialBackend(host *PoolHost) (*downstreamConn, error) {
+	laddr, lport, err := lb.addrManager.Allocate()
+	if err != nil {
+		return nil, err
+	}
+	family := addressFamily(laddr)
+	lsa, err := sockaddr(family, laddr, lport)
+	if err != nil {
+		lb.addrManager.Release(laddr, lport)
+		return nil, err
+	}
+	hsa, err := sockaddr(family, host.Address, host.Port)
+	if err != nil {
+		lb.addrManager.Release(laddr, lport)
+		return nil, err
+	}
+	cfd, err := unix.Socket(family, unix.SOCK_STREAM, unix.IPPROTO_TCP)
+	if err != nil {
+		lb.addrManager.Release(laddr, lport)
+		return nil, err
+	}
+	if err := unix.SetsockoptInt(cfd, unix.SOL_IP, unix.IP_FREEBIND, 1); err != nil {
+		unix.Close(cfd)
+		lb.addrManager.Release(laddr, lport)
+		return nil, err
+	}
+	log.Printf("use [%s]:%d to downstream\n", laddr, lport)
+	if lport != 0 {
+		if err := unix.SetsockoptInt(cfd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+			unix.Close(cfd)
+			lb.addrManager.Release(laddr, lport)
+			return nil, err
+		}
+	}
+	if err := unix.Bind(cfd, lsa); err != nil {
+		unix.Close(cfd)
+		lb.addrManager.Release(laddr, lport)
+		return nil, err
+	}
+	log.Printf("use %s as backend\n", host)
+	start := time.Now()
+	err = connectTimeout(cfd, hsa, lb.backend.ConnectTimeout)
+	lb.outlier.ReportConnect(host, time.Since(start), err)
+	if err != nil {
+		unix.Close(cfd)
+		lb.addrManager.Release(laddr, lport)
+		return nil, err
+	}
+	return &downstreamConn{
+		fd:    cfd,
+		host:  host,
+		laddr: laddr,
+		lport: lport,
+	}, nil
+}
+
 func (lb *lb) destroy(nfd int) (TCPRepair, error) {
 
 	err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR, 1)
 	if err != nil {
-		return TCPRepair{}, nil
+		return TCPRepair{}, err
 	}
 	window, err := GetsockoptTcpRepairWindow(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_WINDOW)
 	if err != nil {
-		return TCPRepair{}, nil
+		return TCPRepair{}, err
 	}
 	mss, err := unix.GetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_MAXSEG)
 	if err != nil {
-		return TCPRepair{}, nil
+		return TCPRepair{}, err
+	}
+	options, err := GetsockoptTcpRepairOptions(nfd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return TCPRepair{}, err
+	}
+	timestamp, err := unix.GetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_TIMESTAMP)
+	if err != nil {
+		return TCPRepair{}, err
+	}
+	sndLen, err := unix.IoctlGetInt(nfd, unix.SIOCOUTQ)
+	if err != nil {
+		return TCPRepair{}, err
+	}
+	sndUnsent, err := unix.IoctlGetInt(nfd, unix.SIOCOUTQNSD)
+	if err != nil {
+		return TCPRepair{}, err
+	}
+	rcvLen, err := unix.IoctlGetInt(nfd, unix.SIOCINQ)
+	if err != nil {
+		return TCPRepair{}, err
 	}
 	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_SEND_QUEUE); err != nil {
-		return TCPRepair{}, nil
+		return TCPRepair{}, err
 	}
 	sndSeq, err := unix.GetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ)
 	if err != nil {
-		return TCPRepair{}, nil
+		return TCPRepair{}, err
+	}
+	sndQueue, err := peekQueue(nfd, sndLen)
+	if err != nil {
+		return TCPRepair{}, err
 	}
 	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_RECV_QUEUE); err != nil {
-		return TCPRepair{}, nil
+		return TCPRepair{}, err
 	}
 	rcvSeq, err := unix.GetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ)
 	if err != nil {
-		if err != nil {
-			return TCPRepair{}, nil
-		}
+		return TCPRepair{}, err
+	}
+	rcvQueue, err := peekQueue(nfd, rcvLen)
+	if err != nil {
+		return TCPRepair{}, err
 	}
 	repair := TCPRepair{
-		Window: window,
-		Mss:    mss,
-		RcvSeq: rcvSeq,
-		SndSeq: sndSeq,
+		Window:    window,
+		Mss:       mss,
+		RcvSeq:    rcvSeq,
+		SndSeq:    sndSeq,
+		SndQueue:  sndQueue,
+		SndUnsent: sndUnsent,
+		RcvQueue:  rcvQueue,
+		Options:   options,
+		Timestamp: uint32(timestamp),
 	}
 	return repair, nil
 }
 
 func (lb *lb) repair(saddr net.IP, sport uint16, daddr net.IP, dport uint16, repair TCPRepair, anyIP bool) (int, error) {
-	nfd, err := unix.Socket(unix.AF_INET6, unix.SOCK_STREAM, 0)
+	family := addressFamily(daddr)
+	lsa, err := sockaddr(family, saddr, sport)
 	if err != nil {
 		return 0, err
 	}
-	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR, 1); err != nil {
+	rsa, err := sockaddr(family, daddr, dport)
+	if err != nil {
 		return 0, err
 	}
-	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_SEND_QUEUE); err != nil {
+	nfd, err := unix.Socket(family, unix.SOCK_STREAM, 0)
+	if err != nil {
 		return 0, err
 	}
-	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ, repair.SndSeq); err != nil {
+	if err := lb.repairSocket(nfd, lsa, rsa, repair, anyIP); err != nil {
+		unix.Close(nfd)
 		return 0, err
 	}
-	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_RECV_QUEUE); err != nil {
-		return 0, err
+	return nfd, nil
+}
+
+func (lb *lb) repairSocket(nfd int, lsa unix.Sockaddr, rsa unix.Sockaddr, repair TCPRepair, anyIP bool) error {
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR, 1); err != nil {
+		return err
 	}
-	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ, repair.RcvSeq); err != nil {
-		return 0, err
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_SEND_QUEUE); err != nil {
+		return err
 	}
-	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ, repair.RcvSeq); err != nil {
-		return 0, err
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ, repair.SndSeq-len(repair.SndQueue)); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_RECV_QUEUE); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_QUEUE_SEQ, repair.RcvSeq-len(repair.RcvQueue)); err != nil {
+		return err
 	}
 	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_MAXSEG, repair.Mss); err != nil {
-		return 0, err
+		return err
 	}
 	if err := SetsockoptTcpRepairWindow(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_WINDOW, repair.Window); err != nil {
-		return 0, err
+		return err
+	}
+	if repair.Options.Timestamps {
+		if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_TIMESTAMP, int(int32(repair.Timestamp))); err != nil {
+			return err
+		}
 	}
 	if anyIP {
 		if err := unix.SetsockoptInt(nfd, unix.SOL_IP, unix.IP_FREEBIND, 1); err != nil {
-			return 0, err
+			return err
 		}
 	}
-	var ip [16]byte
-	copy(ip[:], saddr)
-	if err := unix.Bind(nfd, &unix.SockaddrInet6{
-		Addr: ip,
-		Port: int(sport),
-	}); err != nil {
-		return 0, err
+	if err := unix.Bind(nfd, lsa); err != nil {
+		return err
 	}
-	var addrByte [16]byte
-	copy(addrByte[:], daddr)
-	if err := unix.Connect(nfd, &unix.SockaddrInet6{
-		Port: int(dport),
-		Addr: addrByte,
-	}); err != nil {
-		return 0, err
+	if err := unix.Connect(nfd, rsa); err != nil {
+		return err
+	}
+	if repair.SndUnsent < 0 || repair.SndUnsent > len(repair.SndQueue) {
+		return fmt.Errorf("invalid unsent length: %d", repair.SndUnsent)
+	}
+	if err := SetsockoptTcpRepairOptions(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_OPTIONS, repair.Mss, repair.Options); err != nil {
+		return err
+	}
+	sent := len(repair.SndQueue) - repair.SndUnsent
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_SEND_QUEUE); err != nil {
+		return err
+	}
+	if err := writeAll(nfd, repair.SndQueue[:sent]); err != nil {
+		return err
+	}
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR_QUEUE, TCP_RECV_QUEUE); err != nil {
+		return err
+	}
+	if err := writeAll(nfd, repair.RcvQueue); err != nil {
+		return err
 	}
 	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_REPAIR, 0); err != nil {
-		return 0, err
+		return err
 	}
-	return nfd, nil
+	if err := writeAll(nfd, repair.SndQueue[sent:]); err != nil {
+		return err
+	}
+	return nil
+}
+
+type downstreamError struct {
+	err error
+}
+
+func (e *downstreamError) Error() string {
+	return fmt.Sprintf("downstream: %s", e.err)
 }
 
-func (lb *lb) pipe(nfd int, cfd int, exit chan int) {
+func (lb *lb) pipe(conn *ProxyConn) {
+	conn.pipes.Add(2)
 	go func() {
+		defer conn.pipes.Done()
 		buf := make([]byte, 9000)
 		for {
-			n, err := unix.Read(nfd, buf)
+			readable, err := waitReadable(conn.nfd, conn.stop)
+			if err != nil {
+				log.Printf("error1.0: %s\n", err)
+				conn.finish(err)
+				return
+			}
+			if !readable {
+				return
+			}
+			n, err, werr := conn.relay(conn.nfd, conn.cfd, buf)
 			if err != nil {
 				log.Printf("error1.1: %s\n", err)
-				exit <- 1
+				conn.finish(err)
 				return
 			}
 			log.Printf("rcv1: %d\n", n)
 			if n == 0 {
-				exit <- 1
+				conn.finish(io.EOF)
 				return
 			}
-			if _, err := unix.Write(cfd, buf[:n]); err != nil {
+			if err := werr; err != nil {
 				log.Printf("error1.2: %s\n", err)
-				exit <- 1
+				conn.finish(&downstreamError{err})
 				return
 			}
 		}
 	}()
 
 	go func() {
+		defer conn.pipes.Done()
 		buf := make([]byte, 9000)
 		for {
-			n, err := unix.Read(cfd, buf)
+			readable, err := waitReadable(conn.cfd, conn.stop)
+			if err != nil {
+				log.Printf("error2.0: %s\n", err)
+				conn.finish(err)
+				return
+			}
+			if !readable {
+				return
+			}
+			n, err, werr := conn.relay(conn.cfd, conn.nfd, buf)
 			if err != nil {
 				log.Printf("error2.1: %s\n", err)
-				exit <- 1
+				conn.finish(&downstreamError{err})
 				return
 			}
 			log.Printf("rcv2: %d\n", n)
 			if n == 0 {
-				exit <- 1
+				conn.finish(&downstreamError{io.EOF})
 				return
 			}
-			if _, err := unix.Write(nfd, buf[:n]); err != nil {
+			if err := werr; err != nil {
 				log.Printf("error2.2: %s\n", err)
-				exit <- 1
+				conn.finish(err)
 				return
 			}
 		}
 	}()
 }
 
-func (lb *lb) createRepairInfo(nfd int, cfd int) (TCPRepair, TCPRepair, error) {
+func (lb *lb) createRepairInfo(nfd int, cfd int, daddr net.IP, dport uint16) (TCPRepair, TCPRepair, error) {
+
+	nsa, err := unix.Getsockname(nfd)
+	if err != nil {
+		return TCPRepair{}, TCPRepair{}, err
+	}
+	vip, listen, err := sockaddrIP(nsa)
+	if err != nil {
+		return TCPRepair{}, TCPRepair{}, err
+	}
 
 	repairUpstream, err := lb.destroy(nfd)
 	if err != nil {
 		return TCPRepair{}, TCPRepair{}, err
 	}
+	repairUpstream.Saddr = vip
+	repairUpstream.Sport = listen
 	log.Printf("TCP_REPAIR success")
 
-	sa, err := unix.Getsockname(cfd)
+	csa, err := unix.Getsockname(cfd)
 	if err != nil {
 		return TCPRepair{}, TCPRepair{}, err
 	}
-
-	csa6, ok := sa.(*unix.SockaddrInet6)
-	if !ok {
+	saddr, sport, err := sockaddrIP(csa)
+	if err != nil {
 		return TCPRepair{}, TCPRepair{}, err
 	}
 
@@ -488,10 +1247,10 @@ func (lb *lb) createRepairInfo(nfd int, cfd int) (TCPRepair, TCPRepair, error) {
 	if err != nil {
 		return TCPRepair{}, TCPRepair{}, err
 	}
-	repairDownstream.Saddr = net.IP(csa6.Addr[:])
-	repairDownstream.Sport = uint16(csa6.Port)
-	repairDownstream.Dport = lb.backend.Port
-	repairDownstream.Daddr = lb.backend.Hosts[0]
+	repairDownstream.Saddr = saddr
+	repairDownstream.Sport = sport
+	repairDownstream.Dport = dport
+	repairDownstream.Daddr = daddr
 
 	return repairUpstream, repairDownstream, nil
 }
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hrntknr/term-lb/wire"
+)
+
+const (
+	PeerAlive   = "alive"
+	PeerSuspect = "suspect"
+	PeerDead    = "dead"
+)
+
+type MembershipConfig struct {
+	NodeID       string        `yaml:"nodeID"`
+	Interval     time.Duration `yaml:"interval"`
+	SuspectAfter time.Duration `yaml:"suspectAfter"`
+	DeadAfter    time.Duration `yaml:"deadAfter"`
+}
+
+type Peer struct {
+	Node     string    `json:"node"`
+	Addr     net.IP    `json:"addr"`
+	VIPs     []net.IP  `json:"vips"`
+	Load     uint32    `json:"load"`
+	Version  string    `json:"version"`
+	State    string    `json:"state"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func newMembership(config MembershipConfig) (*Membership, error) {
+	if config.NodeID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		config.NodeID = hostname
+	}
+	if config.Interval == 0 {
+		config.Interval = time.Second
+	}
+	if config.SuspectAfter == 0 {
+		config.SuspectAfter = 3 * config.Interval
+	}
+	if config.DeadAfter == 0 {
+		config.DeadAfter = 10 * config.Interval
+	}
+	return &Membership{
+		config: config,
+		peers:  map[string]*Peer{},
+		mutex:  new(sync.Mutex),
+	}, nil
+}
+
+// Membership tracks peers from their heartbeats. A peer becomes suspect when
+// no heartbeat arrived within SuspectAfter and dead after DeadAfter; it is
+// alive again as soon as it sends one.
+type Membership struct {
+	config MembershipConfig
+	peers  map[string]*Peer
+	mutex  *sync.Mutex
+}
+
+func (m *Membership) Node() string {
+	return m.config.NodeID
+}
+
+func (m *Membership) Observe(addr net.IP, heartbeat *wire.Heartbeat) {
+	if heartbeat.Node == m.config.NodeID {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	peer, ok := m.peers[heartbeat.Node]
+	if !ok {
+		peer = &Peer{Node: heartbeat.Node}
+		m.peers[heartbeat.Node] = peer
+		log.Printf("peer %s joined from %s\n", peer.Node, addr)
+	} else if peer.State != PeerAlive {
+		log.Printf("peer %s is alive\n", peer.Node)
+	}
+	peer.Addr = addr
+	peer.VIPs = heartbeat.VIPs
+	peer.Load = heartbeat.Load
+	peer.Version = heartbeat.Version
+	peer.State = PeerAlive
+	peer.LastSeen = time.Now()
+}
+
+// Run sends a heartbeat built by local every interval and updates the state
+// of peers which stopped sending theirs.
+func (m *Membership) Run(lbnet *LBNetwork, local func() *wire.Heartbeat) {
+	for range time.Tick(m.config.Interval) {
+		heartbeat := local()
+		heartbeat.Node = m.config.NodeID
+		heartbeat.Version = version
+		if err := lbnet.AnnounceMessage(&wire.Message{Type: wire.TypeHeartbeat, Heartbeat: heartbeat}); err != nil {
+			log.Printf("error: %s\n", err)
+		}
+		m.sweep()
+	}
+}
+
+func (m *Membership) sweep() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, peer := range m.peers {
+		state := PeerAlive
+		switch elapsed := time.Since(peer.LastSeen); {
+		case elapsed > m.config.DeadAfter:
+			state = PeerDead
+		case elapsed > m.config.SuspectAfter:
+			state = PeerSuspect
+		}
+		if state != peer.State {
+			log.Printf("peer %s is %s\n", peer.Node, state)
+			peer.State = state
+		}
+	}
+}
+
+// Dead reports whether every node seen at addr is dead. An address which has
+// never sent a heartbeat is not considered dead.
+func (m *Membership) Dead(addr net.IP) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	dead := false
+	for _, peer := range m.peers {
+		if !peer.Addr.Equal(addr) {
+			continue
+		}
+		if peer.State != PeerDead {
+			return false
+		}
+		dead = true
+	}
+	return dead
+}
+
+func (m *Membership) Addr(node string) net.IP {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if peer, ok := m.peers[node]; ok && peer.State != PeerDead {
+		return peer.Addr
+	}
+	return nil
+}
+
+// Pick returns the least loaded alive peer serving vip, or an empty string
+// if none is. A nil vip matches every peer.
+func (m *Membership) Pick(vip net.IP) string {
+	var picked *Peer
+	peers := m.Peers()
+	for i := range peers {
+		if peers[i].State != PeerAlive || !peers[i].serves(vip) {
+			continue
+		}
+		if picked == nil || peers[i].Load < picked.Load {
+			picked = &peers[i]
+		}
+	}
+	if picked == nil {
+		return ""
+	}
+	return picked.Node
+}
+
+// Coordinator reports whether this node has the lowest ID among the alive
+// nodes, so that exactly one of them acts on a dead peer's connections.
+func (m *Membership) Coordinator() bool {
+	for _, peer := range m.Peers() {
+		if peer.State == PeerAlive && peer.Node < m.config.NodeID {
+			return false
+		}
+	}
+	return true
+}
+
+func (peer *Peer) serves(vip net.IP) bool {
+	if vip == nil {
+		return true
+	}
+	for _, v := range peer.VIPs {
+		if v.Equal(vip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Membership) Peers() []Peer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	peers := []Peer{}
+	for _, peer := range m.peers {
+		peers = append(peers, *peer)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Node < peers[j].Node
+	})
+	return peers
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+type OutlierDetectionConfig struct {
+	Interval         time.Duration `yaml:"interval"`
+	ErrorRatio       float64       `yaml:"errorRatio"`
+	MinRequests      int           `yaml:"minRequests"`
+	SlowConnect      time.Duration `yaml:"slowConnect"`
+	EarlyReset       time.Duration `yaml:"earlyReset"`
+	BaseEjectionTime time.Duration `yaml:"baseEjectionTime"`
+	MaxEjectionTime  time.Duration `yaml:"maxEjectionTime"`
+}
+
+type outlierStats struct {
+	requests   int
+	errors     int
+	multiplier int
+}
+
+func newOutlierDetector(config OutlierDetectionConfig, pool *HostPool) *OutlierDetector {
+	if config.Interval == 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.MinRequests == 0 {
+		config.MinRequests = 5
+	}
+	if config.EarlyReset == 0 {
+		config.EarlyReset = time.Second
+	}
+	if config.BaseEjectionTime == 0 {
+		config.BaseEjectionTime = 30 * time.Second
+	}
+	if config.MaxEjectionTime == 0 {
+		config.MaxEjectionTime = 10 * config.BaseEjectionTime
+	}
+	detector := &OutlierDetector{
+		config:     config,
+		pool:       pool,
+		stats:      map[*PoolHost]*outlierStats{},
+		statsMutex: new(sync.Mutex),
+	}
+	go func() {
+		for range time.Tick(config.Interval) {
+			detector.evaluate()
+		}
+	}()
+	return detector
+}
+
+type OutlierDetector struct {
+	config     OutlierDetectionConfig
+	pool       *HostPool
+	stats      map[*PoolHost]*outlierStats
+	statsMutex *sync.Mutex
+}
+
+func (detector *OutlierDetector) ReportConnect(host *PoolHost, latency time.Duration, err error) {
+	if detector == nil {
+		return
+	}
+	failed := err != nil || (detector.config.SlowConnect != 0 && latency > detector.config.SlowConnect)
+	detector.record(host, true, failed)
+}
+
+func (detector *OutlierDetector) ReportReset(host *PoolHost, lifetime time.Duration) {
+	if detector == nil || lifetime > detector.config.EarlyReset {
+		return
+	}
+	detector.record(host, false, true)
+}
+
+func (detector *OutlierDetector) record(host *PoolHost, request bool, failed bool) {
+	detector.statsMutex.Lock()
+	defer detector.statsMutex.Unlock()
+	stats, ok := detector.stats[host]
+	if !ok {
+		stats = &outlierStats{}
+		detector.stats[host] = stats
+	}
+	if request {
+		stats.requests++
+	}
+	if failed {
+		stats.errors++
+	}
+}
+
+func (detector *OutlierDetector) evaluate() {
+	detector.statsMutex.Lock()
+	defer detector.statsMutex.Unlock()
+	now := time.Now()
+	next := map[*PoolHost]*outlierStats{}
+	for _, host := range detector.pool.members() {
+		stats, ok := detector.stats[host]
+		if !ok {
+			stats = &outlierStats{}
+		}
+		next[host] = stats
+		ejected, until := detector.pool.Ejected(host)
+		if ejected && !now.Before(until) {
+			log.Printf("outlier detection: %s is reintroduced\n", host)
+			detector.pool.Reintroduce(host)
+			ejected = false
+		}
+		if !ejected {
+			if stats.requests >= detector.config.MinRequests &&
+				float64(stats.errors)/float64(stats.requests) >= detector.config.ErrorRatio {
+				ejection := detector.config.BaseEjectionTime << uint(stats.multiplier)
+				if ejection >= detector.config.MaxEjectionTime || ejection <= 0 {
+					ejection = detector.config.MaxEjectionTime
+				} else {
+					stats.multiplier++
+				}
+				log.Printf("outlier detection: %s is ejected for %s (%d/%d errors)\n", host, ejection, stats.errors, stats.requests)
+				detector.pool.Eject(host, now.Add(ejection))
+			} else if stats.multiplier > 0 && stats.errors == 0 {
+				stats.multiplier--
+			}
+		}
+		stats.requests = 0
+		stats.errors = 0
+	}
+	detector.stats = next
+}
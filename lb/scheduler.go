@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+)
+
+type Scheduler interface {
+	Schedule(hosts []*PoolHost, ip net.IP, port uint16) *PoolHost
+}
+
+func newScheduler(name string) (Scheduler, error) {
+	switch name {
+	case "", "roundRobin":
+		return &roundRobinScheduler{current: map[*PoolHost]int{}}, nil
+	case "leastConnections":
+		return &leastConnectionsScheduler{}, nil
+	case "randomTwoChoices":
+		return &randomTwoChoicesScheduler{}, nil
+	case "maglev":
+		return &maglevScheduler{}, nil
+	}
+	return nil, fmt.Errorf("unknown scheduler: %s", name)
+}
+
+func lessLoaded(a *PoolHost, b *PoolHost) bool {
+	return a.Conns*b.effectiveWeight < b.Conns*a.effectiveWeight
+}
+
+type roundRobinScheduler struct {
+	current map[*PoolHost]int
+}
+
+func (s *roundRobinScheduler) Schedule(hosts []*PoolHost, ip net.IP, port uint16) *PoolHost {
+	if len(s.current) > len(hosts) {
+		current := map[*PoolHost]int{}
+		for _, host := range hosts {
+			current[host] = s.current[host]
+		}
+		s.current = current
+	}
+	total := 0
+	var selected *PoolHost
+	for _, host := range hosts {
+		s.current[host] += host.effectiveWeight
+		total += host.effectiveWeight
+		if selected == nil || s.current[host] > s.current[selected] {
+			selected = host
+		}
+	}
+	s.current[selected] -= total
+	return selected
+}
+
+type leastConnectionsScheduler struct{}
+
+func (s *leastConnectionsScheduler) Schedule(hosts []*PoolHost, ip net.IP, port uint16) *PoolHost {
+	selected := hosts[0]
+	for _, host := range hosts[1:] {
+		if lessLoaded(host, selected) {
+			selected = host
+		}
+	}
+	return selected
+}
+
+type randomTwoChoicesScheduler struct{}
+
+func (s *randomTwoChoicesScheduler) Schedule(hosts []*PoolHost, ip net.IP, port uint16) *PoolHost {
+	first := weightedRandom(hosts, nil)
+	second := weightedRandom(hosts, first)
+	if second != nil && lessLoaded(second, first) {
+		return second
+	}
+	return first
+}
+
+func weightedRandom(hosts []*PoolHost, exclude *PoolHost) *PoolHost {
+	total := 0
+	for _, host := range hosts {
+		if host != exclude {
+			total += host.effectiveWeight
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	n := rand.Intn(total)
+	for _, host := range hosts {
+		if host == exclude {
+			continue
+		}
+		if n < host.effectiveWeight {
+			return host
+		}
+		n -= host.effectiveWeight
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+var testClient = net.ParseIP("fc00::1")
+
+func newTestHosts(weights ...int) []*PoolHost {
+	hosts := []*PoolHost{}
+	for i, weight := range weights {
+		hosts = append(hosts, &PoolHost{
+			Host:            Host{Address: net.ParseIP(fmt.Sprintf("192.0.2.%d", i+1)), Port: 80, Weight: weight},
+			effectiveWeight: weight * slowStartScale,
+		})
+	}
+	return hosts
+}
+
+func schedule(s Scheduler, hosts []*PoolHost, flows int) map[*PoolHost]int {
+	counts := map[*PoolHost]int{}
+	for port := 0; port < flows; port++ {
+		counts[s.Schedule(hosts, testClient, uint16(port))]++
+	}
+	return counts
+}
+
+func TestNewSchedulerUnknown(t *testing.T) {
+	if _, err := newScheduler("fastest"); err == nil {
+		t.Error("created unknown scheduler")
+	}
+}
+
+func TestRoundRobinWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		want    []int
+	}{
+		{"equal", []int{1, 1, 1}, []int{2, 2, 2}},
+		{"weighted", []int{1, 2, 3}, []int{1, 2, 3}},
+		{"single", []int{5}, []int{6}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := newScheduler("roundRobin")
+			if err != nil {
+				t.Fatal(err)
+			}
+			hosts := newTestHosts(test.weights...)
+			// every round of six is spread by weight
+			for round := 0; round < 3; round++ {
+				counts := schedule(s, hosts, 6)
+				for i, host := range hosts {
+					if counts[host] != test.want[i] {
+						t.Errorf("round %d: scheduled %s %d times, want %d", round, host, counts[host], test.want[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRoundRobinSmooth(t *testing.T) {
+	s, err := newScheduler("roundRobin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := newTestHosts(1, 5)
+	got := ""
+	for port := 0; port < 6; port++ {
+		if s.Schedule(hosts, testClient, uint16(port)) == hosts[0] {
+			got += "a"
+		} else {
+			got += "b"
+		}
+	}
+	if got != "bbabbb" {
+		t.Errorf("scheduled %s, want bbabbb", got)
+	}
+}
+
+func TestLeastConnections(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+		conns   []int
+		want    int
+	}{
+		{"fewest", []int{1, 1, 1}, []int{3, 1, 2}, 1},
+		{"tie goes to the first", []int{1, 1}, []int{2, 2}, 0},
+		{"per weight", []int{1, 4}, []int{1, 3}, 1},
+		{"idle light host", []int{1, 4}, []int{0, 1}, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hosts := newTestHosts(test.weights...)
+			for i, conns := range test.conns {
+				hosts[i].Conns = conns
+			}
+			s, err := newScheduler("leastConnections")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Schedule(hosts, testClient, 1); got != hosts[test.want] {
+				t.Errorf("scheduled %s, want %s", got, hosts[test.want])
+			}
+		})
+	}
+}
+
+func TestRandomTwoChoices(t *testing.T) {
+	hosts := newTestHosts(1, 1)
+	hosts[0].Conns = 10
+	s, err := newScheduler("randomTwoChoices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// with two hosts both are always sampled, so the idle one wins
+	if counts := schedule(s, hosts, 100); counts[hosts[1]] != 100 {
+		t.Errorf("scheduled the idle host %d of 100 times", counts[hosts[1]])
+	}
+	if got := s.Schedule(hosts[:1], testClient, 1); got != hosts[0] {
+		t.Errorf("scheduled %s, want the only host", got)
+	}
+}
+
+func TestWeightedRandom(t *testing.T) {
+	hosts := newTestHosts(1, 3)
+	counts := map[*PoolHost]int{}
+	for i := 0; i < 4000; i++ {
+		counts[weightedRandom(hosts, nil)]++
+	}
+	if counts[hosts[0]] < 800 || counts[hosts[0]] > 1200 {
+		t.Errorf("picked the light host %d of 4000 times, want about 1000", counts[hosts[0]])
+	}
+	if got := weightedRandom(hosts, hosts[1]); got != hosts[0] {
+		t.Errorf("picked %s, want the host not excluded", got)
+	}
+	if got := weightedRandom(hosts[:1], hosts[0]); got != nil {
+		t.Errorf("picked %s from no host", got)
+	}
+}
+
+func TestMaglevConsistent(t *testing.T) {
+	hosts := newTestHosts(1, 1, 1, 1)
+	reversed := []*PoolHost{hosts[3], hosts[2], hosts[1], hosts[0]}
+	first, second := &maglevScheduler{}, &maglevScheduler{}
+	for port := 0; port < 1000; port++ {
+		got := first.Schedule(hosts, testClient, uint16(port))
+		if again := first.Schedule(hosts, testClient, uint16(port)); again != got {
+			t.Fatalf("port %d: scheduled %s, then %s", port, got, again)
+		}
+		// the table does not depend on the order of the hosts
+		if other := second.Schedule(reversed, testClient, uint16(port)); other != got {
+			t.Fatalf("port %d: scheduled %s, and %s in reverse order", port, got, other)
+		}
+	}
+}
+
+func TestMaglevDisruption(t *testing.T) {
+	const flows = 10000
+	hosts := newTestHosts(1, 1, 1, 1, 1, 1, 1, 1, 1, 1)
+	removed := hosts[3]
+	remaining := append(append([]*PoolHost{}, hosts[:3]...), hosts[4:]...)
+	s := &maglevScheduler{}
+	moved, kept := 0, 0
+	for port := 0; port < flows; port++ {
+		before := s.Schedule(hosts, testClient, uint16(port))
+		after := s.Schedule(remaining, testClient, uint16(port))
+		if after == removed {
+			t.Fatalf("port %d: scheduled the removed host", port)
+		}
+		if before == removed {
+			continue
+		}
+		kept++
+		if after != before {
+			moved++
+		}
+	}
+	// only the flows of the removed host have to move
+	if moved*100 > kept*2 {
+		t.Errorf("moved %d of %d flows of the remaining hosts", moved, kept)
+	}
+}
+
+func TestMaglevWeighted(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights []int
+	}{
+		{"equal", []int{1, 1}},
+		{"weighted", []int{1, 3}},
+		{"three", []int{2, 3, 5}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hosts := newTestHosts(test.weights...)
+			total := 0
+			for _, weight := range test.weights {
+				total += weight
+			}
+			entries := map[*PoolHost]int{}
+			for _, host := range maglevPopulate(hosts) {
+				entries[host]++
+			}
+			for i, host := range hosts {
+				want := maglevTableSize * test.weights[i] / total
+				if diff := entries[host] - want; diff > maglevTableSize/100 || diff < -maglevTableSize/100 {
+					t.Errorf("%s has %d entries, want about %d", host, entries[host], want)
+				}
+			}
+		})
+	}
+}
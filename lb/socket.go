@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func addressFamily(ip net.IP) int {
+	if ip.To4() != nil {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func sockaddr(family int, ip net.IP, port uint16) (unix.Sockaddr, error) {
+	switch family {
+	case unix.AF_INET:
+		ip4 := ip.To4()
+		if ip4 == nil {
+			return nil, fmt.Errorf("not an IPv4 address: %s", ip)
+		}
+		sa := &unix.SockaddrInet4{Port: int(port)}
+		copy(sa.Addr[:], ip4)
+		return sa, nil
+	case unix.AF_INET6:
+		ip16 := ip.To16()
+		if ip16 == nil {
+			return nil, fmt.Errorf("invalid address: %s", ip)
+		}
+		sa := &unix.SockaddrInet6{Port: int(port)}
+		copy(sa.Addr[:], ip16)
+		return sa, nil
+	}
+	return nil, fmt.Errorf("unknown address family: %d", family)
+}
+
+func sockaddrIP(sa unix.Sockaddr) (net.IP, uint16, error) {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		return net.IP(append([]byte{}, sa.Addr[:]...)), uint16(sa.Port), nil
+	case *unix.SockaddrInet6:
+		ip := net.IP(append([]byte{}, sa.Addr[:]...))
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return ip, uint16(sa.Port), nil
+	}
+	return nil, 0, fmt.Errorf("unsupported socket address: %T", sa)
+}
+
+func connectTimeout(fd int, sa unix.Sockaddr, timeout time.Duration) error {
+	if timeout == 0 {
+		return unix.Connect(fd, sa)
+	}
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return err
+	}
+	err := unix.Connect(fd, sa)
+	if err == unix.EINPROGRESS {
+		err = waitConnect(fd, time.Now().Add(timeout))
+	}
+	if err != nil {
+		return err
+	}
+	return unix.SetNonblock(fd, false)
+}
+
+func waitConnect(fd int, deadline time.Time) error {
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return unix.ETIMEDOUT
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLOUT}}
+		n, err := unix.Poll(fds, int(remaining/time.Millisecond)+1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		soerr, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			return err
+		}
+		if soerr != 0 {
+			return unix.Errno(soerr)
+		}
+		return nil
+	}
+}
+
+func writeAll(fd int, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := unix.Write(fd, buf)
+		if err != nil {
+			return err
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
+
+func waitReadable(fd int, stop int) (bool, error) {
+	fds := []unix.PollFd{
+		{Fd: int32(fd), Events: unix.POLLIN},
+		{Fd: int32(stop), Events: unix.POLLIN},
+	}
+	for {
+		_, err := unix.Poll(fds, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if fds[1].Revents != 0 {
+			return false, nil
+		}
+		return true, nil
+	}
+}
+
+func signalEventfd(fd int) error {
+	_, err := unix.Write(fd, []byte{1, 0, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -23,6 +23,9 @@ type Connection struct {
 	State state
 	IP    net.IP
 	Port  uint16
+
+	// the first packet of the unknown flow, answered by Reset
+	packet gopacket.Packet
 }
 
 func newTCPHook(pcapIf string, port uint16) (*TCPHook, error) {
@@ -33,6 +36,7 @@ func newTCPHook(pcapIf string, port uint16) (*TCPHook, error) {
 	connMutex := new(sync.Mutex)
 
 	hook := &TCPHook{
+		handle:      handle,
 		connections: map[string]Connection{},
 		connMutex:   connMutex,
 	}
@@ -51,27 +55,35 @@ func newTCPHook(pcapIf string, port uint16) (*TCPHook, error) {
 			if uint16(tcpPacket.DstPort) != port {
 				continue
 			}
-			ipPacket, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6)
-			if !ok {
+			var srcIP net.IP
+			if ipPacket, ok := packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+				srcIP = ipPacket.SrcIP
+			} else if ipPacket, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+				srcIP = ipPacket.SrcIP
+			} else {
 				continue
 			}
+			if ip4 := srcIP.To4(); ip4 != nil {
+				srcIP = ip4
+			}
 			hook.connMutex.Lock()
-			_, ok = hook.connections[fmt.Sprintf("[%s]:%d", ipPacket.SrcIP, tcpPacket.SrcPort)]
+			_, ok = hook.connections[fmt.Sprintf("[%s]:%d", srcIP, tcpPacket.SrcPort)]
 			hook.connMutex.Unlock()
 			if ok {
 				continue
 			}
 
-			log.Printf("unknown: [%s]:%d\n", ipPacket.SrcIP, tcpPacket.SrcPort)
+			log.Printf("unknown: [%s]:%d\n", srcIP, tcpPacket.SrcPort)
 			hook.connMutex.Lock()
-			hook.connections[fmt.Sprintf("[%s]:%d", ipPacket.SrcIP, tcpPacket.SrcPort)] = Connection{
-				State: StateMigration,
-				IP:    ipPacket.SrcIP,
-				Port:  uint16(tcpPacket.SrcPort),
+			hook.connections[fmt.Sprintf("[%s]:%d", srcIP, tcpPacket.SrcPort)] = Connection{
+				State:  StateMigration,
+				IP:     srcIP,
+				Port:   uint16(tcpPacket.SrcPort),
+				packet: packet,
 			}
 			hook.connMutex.Unlock()
 			for _, handler := range hook.handler {
-				handler(ipPacket.SrcIP, uint16(tcpPacket.SrcPort))
+				handler(srcIP, uint16(tcpPacket.SrcPort))
 			}
 		}
 	}()
@@ -101,7 +113,84 @@ func (hook *TCPHook) CloseEvent(ip net.IP, port uint16, margin time.Duration) {
 	}()
 }
 
+// Pending reports whether the flow is still waiting for its connection to be
+// restored from a peer.
+func (hook *TCPHook) Pending(ip net.IP, port uint16) bool {
+	hook.connMutex.Lock()
+	defer hook.connMutex.Unlock()
+	conn, ok := hook.connections[fmt.Sprintf("[%s]:%d", ip, port)]
+	return ok && conn.State == StateMigration
+}
+
+// Forget drops the flow, so the next packet of it is looked up again.
+func (hook *TCPHook) Forget(ip net.IP, port uint16) {
+	hook.connMutex.Lock()
+	defer hook.connMutex.Unlock()
+	delete(hook.connections, fmt.Sprintf("[%s]:%d", ip, port))
+}
+
+// Reset answers the first unknown packet of the flow with a RST. It is
+// injected on the capture interface since the kernel's RSTs are filtered.
+func (hook *TCPHook) Reset(ip net.IP, port uint16) error {
+	hook.connMutex.Lock()
+	conn, ok := hook.connections[fmt.Sprintf("[%s]:%d", ip, port)]
+	hook.connMutex.Unlock()
+	if !ok || conn.packet == nil {
+		return fmt.Errorf("no packet to reset [%s]:%d", ip, port)
+	}
+	eth, ok := conn.packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		return fmt.Errorf("unsupported link layer to reset [%s]:%d", ip, port)
+	}
+	tcpPacket := conn.packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	rst := &layers.TCP{
+		SrcPort: tcpPacket.DstPort,
+		DstPort: tcpPacket.SrcPort,
+		RST:     true,
+	}
+	if tcpPacket.ACK {
+		rst.Seq = tcpPacket.Ack
+	} else {
+		rst.ACK = true
+		rst.Ack = tcpPacket.Seq + uint32(len(tcpPacket.Payload))
+	}
+	var network gopacket.SerializableLayer
+	if ipPacket, ok := conn.packet.Layer(layers.LayerTypeIPv6).(*layers.IPv6); ok {
+		reply := &layers.IPv6{
+			Version:    6,
+			NextHeader: layers.IPProtocolTCP,
+			HopLimit:   64,
+			SrcIP:      ipPacket.DstIP,
+			DstIP:      ipPacket.SrcIP,
+		}
+		rst.SetNetworkLayerForChecksum(reply)
+		network = reply
+	} else if ipPacket, ok := conn.packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ok {
+		reply := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      64,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    ipPacket.DstIP,
+			DstIP:    ipPacket.SrcIP,
+		}
+		rst.SetNetworkLayerForChecksum(reply)
+		network = reply
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		&layers.Ethernet{SrcMAC: eth.DstMAC, DstMAC: eth.SrcMAC, EthernetType: eth.EthernetType},
+		network,
+		rst,
+	)
+	if err != nil {
+		return err
+	}
+	return hook.handle.WritePacketData(buf.Bytes())
+}
+
 type TCPHook struct {
+	handle      *pcap.Handle
 	connections map[string]Connection
 	connMutex   *sync.Mutex
 	handler     []func(net.IP, uint16)
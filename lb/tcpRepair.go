@@ -10,6 +10,9 @@ import (
 	"fmt"
 	"net"
 	"unsafe"
+
+	"github.com/hrntknr/term-lb/wire"
+	"golang.org/x/sys/unix"
 )
 
 type TCPRepair struct {
@@ -21,6 +24,21 @@ type TCPRepair struct {
 	SndSeq int             `json:"snd_seq"`
 	RcvSeq int             `json:"rcv_seq"`
 	Mss    int             `json:"mss"`
+
+	SndQueue  []byte `json:"snd_queue"`
+	SndUnsent int    `json:"snd_unsent"`
+	RcvQueue  []byte `json:"rcv_queue"`
+
+	Options   TCPRepairOptions `json:"options"`
+	Timestamp uint32           `json:"timestamp"`
+}
+
+type TCPRepairOptions struct {
+	SndWscale  uint8 `json:"snd_wscale"`
+	RcvWscale  uint8 `json:"rcv_wscale"`
+	Wscale     bool  `json:"wscale"`
+	Sack       bool  `json:"sack"`
+	Timestamps bool  `json:"timestamps"`
 }
 
 type TCPRepairWindow struct {
@@ -31,9 +49,72 @@ type TCPRepairWindow struct {
 	RcvWup    uint32 `json:"rcv_wup"`
 }
 
+func (repair TCPRepair) wire() *wire.Repair {
+	return &wire.Repair{
+		Saddr:      repair.Saddr,
+		Sport:      repair.Sport,
+		Daddr:      repair.Daddr,
+		Dport:      repair.Dport,
+		SndWl1:     repair.Window.SndWl1,
+		SndWnd:     repair.Window.SndWnd,
+		MaxWindow:  repair.Window.MaxWindow,
+		RcvWnd:     repair.Window.RcvWnd,
+		RcvWup:     repair.Window.RcvWup,
+		SndSeq:     uint32(repair.SndSeq),
+		RcvSeq:     uint32(repair.RcvSeq),
+		Mss:        uint32(repair.Mss),
+		Timestamp:  repair.Timestamp,
+		SndWscale:  repair.Options.SndWscale,
+		RcvWscale:  repair.Options.RcvWscale,
+		Wscale:     repair.Options.Wscale,
+		Sack:       repair.Options.Sack,
+		Timestamps: repair.Options.Timestamps,
+		SndQueue:   repair.SndQueue,
+		SndUnsent:  uint32(repair.SndUnsent),
+		RcvQueue:   repair.RcvQueue,
+	}
+}
+
+func tcpRepairFromWire(repair *wire.Repair) TCPRepair {
+	return TCPRepair{
+		Saddr: repair.Saddr,
+		Sport: repair.Sport,
+		Daddr: repair.Daddr,
+		Dport: repair.Dport,
+		Window: TCPRepairWindow{
+			SndWl1:    repair.SndWl1,
+			SndWnd:    repair.SndWnd,
+			MaxWindow: repair.MaxWindow,
+			RcvWnd:    repair.RcvWnd,
+			RcvWup:    repair.RcvWup,
+		},
+		SndSeq:    int(int32(repair.SndSeq)),
+		RcvSeq:    int(int32(repair.RcvSeq)),
+		Mss:       int(repair.Mss),
+		SndQueue:  repair.SndQueue,
+		SndUnsent: int(repair.SndUnsent),
+		RcvQueue:  repair.RcvQueue,
+		Options: TCPRepairOptions{
+			SndWscale:  repair.SndWscale,
+			RcvWscale:  repair.RcvWscale,
+			Wscale:     repair.Wscale,
+			Sack:       repair.Sack,
+			Timestamps: repair.Timestamps,
+		},
+		Timestamp: repair.Timestamp,
+	}
+}
+
 var TCP_SEND_QUEUE = C.TCP_SEND_QUEUE
 var TCP_RECV_QUEUE = C.TCP_RECV_QUEUE
 
+const (
+	TCPOPT_MSS       = 2
+	TCPOPT_WINDOW    = 3
+	TCPOPT_SACK_PERM = 4
+	TCPOPT_TIMESTAMP = 8
+)
+
 func GetsockoptTcpRepairWindow(fd int, level int, opt int) (TCPRepairWindow, error) {
 	val := C.struct_tcp_repair_window{}
 	len := C.uint(C.sizeof_struct_tcp_repair_window)
@@ -65,3 +146,61 @@ func SetsockoptTcpRepairWindow(fd int, level int, opt int, window TCPRepairWindo
 	}
 	return nil
 }
+
+func peekQueue(fd int, size int) ([]byte, error) {
+	if size == 0 {
+		return []byte{}, nil
+	}
+	buf := make([]byte, size)
+	n, _, err := unix.Recvfrom(fd, buf, unix.MSG_PEEK|unix.MSG_DONTWAIT)
+	if err != nil {
+		return nil, err
+	}
+	if n != size {
+		return nil, fmt.Errorf("short queue read: %d/%d", n, size)
+	}
+	return buf, nil
+}
+
+func GetsockoptTcpRepairOptions(fd int, level int, opt int) (TCPRepairOptions, error) {
+	val := C.struct_tcp_info{}
+	len := C.uint(C.sizeof_struct_tcp_info)
+	result, err := C.getsockopt(C.int(fd), C.int(level), C.int(opt), unsafe.Pointer(&val), &len)
+	if result < 0 {
+		return TCPRepairOptions{}, fmt.Errorf("getsockopt() failed. %s", err)
+	}
+	// tcpi_snd_wscale and tcpi_rcv_wscale are 4 bit fields following tcpi_options.
+	wscale := *(*uint8)(unsafe.Pointer(uintptr(unsafe.Pointer(&val.tcpi_options)) + 1))
+	return TCPRepairOptions{
+		SndWscale:  wscale & 0x0f,
+		RcvWscale:  wscale >> 4,
+		Wscale:     val.tcpi_options&C.TCPI_OPT_WSCALE != 0,
+		Sack:       val.tcpi_options&C.TCPI_OPT_SACK != 0,
+		Timestamps: val.tcpi_options&C.TCPI_OPT_TIMESTAMPS != 0,
+	}, nil
+}
+
+func SetsockoptTcpRepairOptions(fd int, level int, opt int, mss int, options TCPRepairOptions) error {
+	opts := []C.struct_tcp_repair_opt{{
+		opt_code: TCPOPT_MSS,
+		opt_val:  C.__u32(mss),
+	}}
+	if options.Wscale {
+		opts = append(opts, C.struct_tcp_repair_opt{
+			opt_code: TCPOPT_WINDOW,
+			opt_val:  C.__u32(options.SndWscale) | C.__u32(options.RcvWscale)<<16,
+		})
+	}
+	if options.Sack {
+		opts = append(opts, C.struct_tcp_repair_opt{opt_code: TCPOPT_SACK_PERM})
+	}
+	if options.Timestamps {
+		opts = append(opts, C.struct_tcp_repair_opt{opt_code: TCPOPT_TIMESTAMP})
+	}
+	optlen := C.uint(C.sizeof_struct_tcp_repair_opt * len(opts))
+	result, err := C.setsockopt(C.int(fd), C.int(level), C.int(opt), unsafe.Pointer(&opts[0]), optlen)
+	if result < 0 {
+		return fmt.Errorf("setsockopt() failed. %s", err)
+	}
+	return nil
+}
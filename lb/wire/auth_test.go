@@ -0,0 +1,228 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testPeerA = net.ParseIP("fc00::a")
+	testPeerB = net.ParseIP("fc00::b")
+)
+
+func newTestAuthenticator(t *testing.T, keys []Key, sendKey uint32, encrypt bool) *Authenticator {
+	a, err := NewAuthenticator(keys, sendKey, time.Minute, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func sealOne(t *testing.T, a *Authenticator, payload []byte) []byte {
+	sealed, err := a.Seal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != 1 {
+		t.Fatalf("sealed %d datagrams, want 1", len(sealed))
+	}
+	return sealed[0]
+}
+
+func TestNewAuthenticatorInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []Key
+		sendKey uint32
+	}{
+		{"duplicate key", []Key{{ID: 1, Secret: []byte("a")}, {ID: 1, Secret: []byte("b")}}, 1},
+		{"unknown send key", []Key{{ID: 1, Secret: []byte("a")}}, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewAuthenticator(test.keys, test.sendKey, time.Minute, false); err == nil {
+				t.Error("created invalid authenticator")
+			}
+		})
+	}
+}
+
+func TestAuthOpen(t *testing.T) {
+	keys := []Key{{ID: 1, Secret: []byte("old")}, {ID: 2, Secret: []byte("new")}}
+	sender := newTestAuthenticator(t, keys, 2, false)
+	payload := []byte("payload")
+	valid := sealOne(t, sender, payload)
+	tamper := func(i int) []byte {
+		buf := append([]byte{}, valid...)
+		buf[i] ^= 1
+		return buf
+	}
+	tests := []struct {
+		name string
+		keys []Key
+		buf  []byte
+		err  string
+	}{
+		{"valid", keys, valid, ""},
+		{"rotated out key", keys[1:], sealOne(t, newTestAuthenticator(t, keys, 1, false), payload), ErrUnknownKey.Error()},
+		{"unknown key", keys[:1], valid, ErrUnknownKey.Error()},
+		{"wrong secret", []Key{keys[0], {ID: 2, Secret: []byte("other")}}, valid, "invalid mac"},
+		{"tampered payload", keys, tamper(authHeadLen), "invalid mac"},
+		{"tampered timestamp", keys, tamper(4), "invalid mac"},
+		{"tampered mac", keys, tamper(len(valid) - 1), "invalid mac"},
+		{"short", keys, valid[:authHeadLen-1], "unauthenticated message"},
+		{"no mac", keys, valid[:authHeadLen+macLen-1], "unauthenticated message"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newTestAuthenticator(t, test.keys, test.keys[0].ID, false)
+			opened, err := receiver.Open(test.buf, testPeerA)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(opened, payload) {
+					t.Errorf("opened %q, want %q", opened, payload)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestAuthReplay(t *testing.T) {
+	keys := []Key{{ID: 1, Secret: []byte("secret")}}
+	a := newTestAuthenticator(t, keys, 1, false)
+	buf := sealOne(t, a, []byte("payload"))
+	if _, err := a.Open(buf, testPeerA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Open(buf, testPeerA); err == nil || !strings.Contains(err.Error(), "replayed") {
+		t.Errorf("got error %v, want replayed", err)
+	}
+}
+
+func TestAuthStale(t *testing.T) {
+	keys := []Key{{ID: 1, Secret: []byte("secret")}}
+	a, err := NewAuthenticator(keys, 1, time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := sealOne(t, a, []byte("payload"))
+	time.Sleep(5 * time.Millisecond)
+	if _, err := a.Open(buf, testPeerA); err == nil || !strings.Contains(err.Error(), "stale") {
+		t.Errorf("got error %v, want stale", err)
+	}
+}
+
+func TestAuthPruneNonces(t *testing.T) {
+	keys := []Key{{ID: 1, Secret: []byte("secret")}}
+	a, err := NewAuthenticator(keys, 1, 10*time.Millisecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := a.Open(sealOne(t, a, []byte("payload")), testPeerA); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(25 * time.Millisecond)
+	if _, err := a.Open(sealOne(t, a, []byte("payload")), testPeerA); err != nil {
+		t.Fatal(err)
+	}
+	if len(a.seen) != 1 || len(a.order) != 1 {
+		t.Errorf("kept %d nonces in %d queued, want 1", len(a.seen), len(a.order))
+	}
+}
+
+func TestAuthPerPeer(t *testing.T) {
+	keys := []Key{
+		{ID: 1, Secret: []byte("a1"), Peer: testPeerA},
+		{ID: 2, Secret: []byte("a2"), Peer: testPeerA},
+		{ID: 3, Secret: []byte("b"), Peer: testPeerB},
+	}
+	sender := newTestAuthenticator(t, keys, 0, false)
+	if !sender.PerPeer() {
+		t.Fatal("not per peer")
+	}
+	sealed, err := sender.Seal([]byte("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != 2 {
+		t.Fatalf("sealed %d datagrams, want one per peer", len(sealed))
+	}
+
+	// the sender's address is the peer each receiver shares the key with
+	self := net.ParseIP("fc00::1")
+	receiverA := newTestAuthenticator(t, []Key{{ID: 2, Secret: []byte("a2"), Peer: self}}, 0, false)
+	receiverB := newTestAuthenticator(t, []Key{{ID: 3, Secret: []byte("b"), Peer: self}}, 0, false)
+	for _, buf := range sealed {
+		_, errA := receiverA.Open(buf, self)
+		_, errB := receiverB.Open(buf, self)
+		if (errA == nil) == (errB == nil) {
+			t.Errorf("opened by both or neither: %v, %v", errA, errB)
+		}
+		for _, err := range []error{errA, errB} {
+			if err != nil && err != ErrUnknownKey {
+				t.Errorf("got error %v, want %v", err, ErrUnknownKey)
+			}
+		}
+	}
+	if _, err := receiverA.Open(sealed[0], testPeerB); err == nil {
+		t.Error("opened a peer key from another address")
+	}
+}
+
+func TestAuthEncrypt(t *testing.T) {
+	keys := []Key{{ID: 1, Secret: []byte("secret")}}
+	sender := newTestAuthenticator(t, keys, 1, true)
+	payload := []byte("confidential payload")
+	valid := sealOne(t, sender, payload)
+	if bytes.Contains(valid, payload) {
+		t.Fatal("payload sent in clear")
+	}
+	tamper := func(i int) []byte {
+		buf := append([]byte{}, valid...)
+		buf[i] ^= 1
+		return buf
+	}
+	signed := sealOne(t, newTestAuthenticator(t, keys, 1, false), payload)
+	tests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"valid", valid, ""},
+		{"tampered ciphertext", tamper(authHeadLen), "invalid message"},
+		{"tampered timestamp", tamper(4), "invalid message"},
+		{"tampered nonce", tamper(12), "invalid message"},
+		{"tampered tag", tamper(len(valid) - 1), "invalid message"},
+		{"no tag", valid[:authHeadLen], "invalid message"},
+		{"signed only", signed, "invalid message"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			receiver := newTestAuthenticator(t, keys, 1, true)
+			opened, err := receiver.Open(test.buf, testPeerA)
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(opened, payload) {
+					t.Errorf("opened %q, want %q", opened, payload)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
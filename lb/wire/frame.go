@@ -0,0 +1,76 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Frames carry messages over datagrams. A message is split into Count
+// fragments which share the sender's Epoch and MsgID; reliable fragments are
+// acknowledged one by one with an ack frame echoing Epoch, MsgID and Index.
+//
+//	kind(1) | flags(1) | epoch(4) | msgID(4) | index(2) | count(2) | payload
+const frameHeadLen = 14
+
+type FrameKind uint8
+
+const (
+	FrameData FrameKind = iota + 1
+	FrameAck
+)
+
+const flagReliable = 1
+
+type Frame struct {
+	Kind     FrameKind
+	Reliable bool
+	Epoch    uint32
+	MsgID    uint32
+	Index    uint16
+	Count    uint16
+	Payload  []byte
+}
+
+func EncodeFrame(frame *Frame) []byte {
+	buf := make([]byte, frameHeadLen, frameHeadLen+len(frame.Payload))
+	buf[0] = uint8(frame.Kind)
+	if frame.Reliable {
+		buf[1] = flagReliable
+	}
+	binary.BigEndian.PutUint32(buf[2:], frame.Epoch)
+	binary.BigEndian.PutUint32(buf[6:], frame.MsgID)
+	binary.BigEndian.PutUint16(buf[10:], frame.Index)
+	binary.BigEndian.PutUint16(buf[12:], frame.Count)
+	return append(buf, frame.Payload...)
+}
+
+func DecodeFrame(buf []byte) (*Frame, error) {
+	if len(buf) < frameHeadLen {
+		return nil, fmt.Errorf("short frame: %d bytes", len(buf))
+	}
+	frame := &Frame{
+		Kind:     FrameKind(buf[0]),
+		Reliable: buf[1]&flagReliable != 0,
+		Epoch:    binary.BigEndian.Uint32(buf[2:]),
+		MsgID:    binary.BigEndian.Uint32(buf[6:]),
+		Index:    binary.BigEndian.Uint16(buf[10:]),
+		Count:    binary.BigEndian.Uint16(buf[12:]),
+		Payload:  buf[frameHeadLen:],
+	}
+	if buf[1]&^flagReliable != 0 {
+		return nil, fmt.Errorf("unknown frame flags: %#x", buf[1])
+	}
+	switch frame.Kind {
+	case FrameData:
+		if frame.Count == 0 || frame.Index >= frame.Count {
+			return nil, fmt.Errorf("invalid fragment %d/%d", frame.Index, frame.Count)
+		}
+	case FrameAck:
+		if len(frame.Payload) != 0 {
+			return nil, fmt.Errorf("ack frame with payload")
+		}
+	default:
+		return nil, fmt.Errorf("unknown frame kind: %d", buf[0])
+	}
+	return frame, nil
+}
@@ -0,0 +1,57 @@
+package wire
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"data", &Frame{Kind: FrameData, Epoch: 1, MsgID: 2, Index: 0, Count: 1, Payload: []byte("message")}},
+		{"reliable fragment", &Frame{Kind: FrameData, Reliable: true, Epoch: 0xffffffff, MsgID: 3, Index: 4, Count: 5, Payload: []byte{0}}},
+		{"empty data", &Frame{Kind: FrameData, Reliable: true, Index: 0, Count: 1, Payload: []byte{}}},
+		{"ack", &Frame{Kind: FrameAck, Epoch: 1, MsgID: 2, Index: 3, Count: 4, Payload: []byte{}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decoded, err := DecodeFrame(EncodeFrame(test.frame))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, test.frame) {
+				t.Errorf("decoded %+v, want %+v", decoded, test.frame)
+			}
+		})
+	}
+}
+
+func TestDecodeFrameInvalid(t *testing.T) {
+	data := EncodeFrame(&Frame{Kind: FrameData, Index: 0, Count: 1, Payload: []byte("message")})
+	modify := func(f func(buf []byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"truncated", data[:frameHeadLen-1], "short frame"},
+		{"unknown kind", modify(func(buf []byte) []byte { buf[0] = 0; return buf }), "unknown frame kind"},
+		{"unknown flags", modify(func(buf []byte) []byte { buf[1] = 0x80; return buf }), "unknown frame flags"},
+		{"zero count", modify(func(buf []byte) []byte { buf[13] = 0; return buf }), "invalid fragment"},
+		{"index beyond count", modify(func(buf []byte) []byte { buf[11] = 1; return buf }), "invalid fragment"},
+		{"ack with payload", modify(func(buf []byte) []byte { buf[0] = uint8(FrameAck); return buf }), "ack frame with payload"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := DecodeFrame(test.buf)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
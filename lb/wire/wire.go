@@ -0,0 +1,459 @@
+// Package wire implements the message format spoken between term-lb
+// instances on the LBNetwork.
+//
+// Every message starts with a 6 byte header: the protocol version, the
+// message type and the big-endian length of the payload that follows.
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+const Version = 1
+
+const headerLen = 6
+
+// strings and lists are prefixed with a 16 bit length
+const maxString = 1<<16 - 1
+
+type Type uint8
+
+const (
+	TypeLookup Type = iota + 1
+	TypeOffer
+	TypeRestore
+	TypeAck
+	TypeNack
+	TypeHeartbeat
+	TypeRelease
+	TypeCheckpoint
+	TypeForget
+	TypeAbort
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeLookup:
+		return "lookup"
+	case TypeOffer:
+		return "offer"
+	case TypeRestore:
+		return "restore"
+	case TypeAck:
+		return "ack"
+	case TypeNack:
+		return "nack"
+	case TypeHeartbeat:
+		return "heartbeat"
+	case TypeRelease:
+		return "release"
+	case TypeCheckpoint:
+		return "checkpoint"
+	case TypeForget:
+		return "forget"
+	case TypeAbort:
+		return "abort"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(t))
+}
+
+type VersionError struct {
+	Version uint8
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("unknown protocol version: %d", e.Version)
+}
+
+// Message is a decoded LBNetwork message. Flow is the client flow for every
+// type except release, where it is the downstream (address, port) tuple, and
+// heartbeat, which carries Heartbeat instead. Node is the requesting node of
+// a lookup and the node a restore or abort is addressed to, empty for any
+// node. Attempt identifies the migration a restore, abort, ack or nack
+// belongs to.
+// Upstream and Downstream are set for restore and checkpoint only.
+type Message struct {
+	Type       Type
+	Flow       Flow
+	Node       string
+	Attempt    uint32
+	Upstream   *Repair
+	Downstream *Repair
+	Heartbeat  *Heartbeat
+}
+
+type Heartbeat struct {
+	Node    string
+	Version string
+	Load    uint32
+	VIPs    []net.IP
+}
+
+func (msg *Message) String() string {
+	if msg.Type == TypeHeartbeat {
+		return fmt.Sprintf("%s %s", msg.Type, msg.Heartbeat.Node)
+	}
+	if msg.Node != "" {
+		return fmt.Sprintf("%s %s %s", msg.Type, msg.Flow, msg.Node)
+	}
+	return fmt.Sprintf("%s %s", msg.Type, msg.Flow)
+}
+
+type Flow struct {
+	Addr net.IP
+	Port uint16
+}
+
+func (flow Flow) String() string {
+	return fmt.Sprintf("[%s]:%d", flow.Addr, flow.Port)
+}
+
+type Repair struct {
+	Saddr net.IP
+	Sport uint16
+	Daddr net.IP
+	Dport uint16
+
+	SndWl1    uint32
+	SndWnd    uint32
+	MaxWindow uint32
+	RcvWnd    uint32
+	RcvWup    uint32
+
+	SndSeq    uint32
+	RcvSeq    uint32
+	Mss       uint32
+	Timestamp uint32
+
+	SndWscale  uint8
+	RcvWscale  uint8
+	Wscale     bool
+	Sack       bool
+	Timestamps bool
+
+	SndQueue  []byte
+	SndUnsent uint32
+	RcvQueue  []byte
+}
+
+const (
+	flagWscale = 1 << iota
+	flagSack
+	flagTimestamps
+)
+
+func (t Type) hasFlow() bool {
+	return t != TypeHeartbeat
+}
+
+func (t Type) hasNode() bool {
+	return t == TypeLookup || t == TypeRestore || t == TypeAbort
+}
+
+func (t Type) hasAttempt() bool {
+	return t == TypeRestore || t == TypeAbort || t == TypeAck || t == TypeNack
+}
+
+func (t Type) hasRepair() bool {
+	return t == TypeRestore || t == TypeCheckpoint
+}
+
+func (t Type) valid() bool {
+	return t >= TypeLookup && t <= TypeAbort
+}
+
+func Encode(msg *Message) ([]byte, error) {
+	if err := validate(msg); err != nil {
+		return nil, err
+	}
+	payload := &bytes.Buffer{}
+	if msg.Type.hasFlow() {
+		putAddr(payload, msg.Flow.Addr)
+		putUint16(payload, msg.Flow.Port)
+	}
+	if msg.Type.hasNode() {
+		putString(payload, msg.Node)
+	}
+	if msg.Type.hasAttempt() {
+		putUint32(payload, msg.Attempt)
+	}
+	if msg.Type.hasRepair() {
+		putRepair(payload, msg.Upstream)
+		putRepair(payload, msg.Downstream)
+	}
+	if msg.Type == TypeHeartbeat {
+		putHeartbeat(payload, msg.Heartbeat)
+	}
+	buf := make([]byte, headerLen, headerLen+payload.Len())
+	buf[0] = Version
+	buf[1] = uint8(msg.Type)
+	binary.BigEndian.PutUint32(buf[2:], uint32(payload.Len()))
+	return append(buf, payload.Bytes()...), nil
+}
+
+func Decode(buf []byte) (*Message, error) {
+	if len(buf) < headerLen {
+		return nil, fmt.Errorf("short message: %d bytes", len(buf))
+	}
+	if buf[0] != Version {
+		return nil, &VersionError{Version: buf[0]}
+	}
+	msg := &Message{Type: Type(buf[1])}
+	if !msg.Type.valid() {
+		return nil, fmt.Errorf("unknown message type: %d", buf[1])
+	}
+	length := binary.BigEndian.Uint32(buf[2:])
+	if uint64(length) != uint64(len(buf)-headerLen) {
+		return nil, fmt.Errorf("length mismatch: header %d, payload %d", length, len(buf)-headerLen)
+	}
+	r := &reader{buf: buf[headerLen:]}
+	if msg.Type.hasFlow() {
+		msg.Flow.Addr = r.addr()
+		msg.Flow.Port = r.uint16()
+	}
+	if msg.Type.hasNode() {
+		msg.Node = r.string()
+	}
+	if msg.Type.hasAttempt() {
+		msg.Attempt = r.uint32()
+	}
+	if msg.Type.hasRepair() {
+		msg.Upstream = r.repair()
+		msg.Downstream = r.repair()
+	}
+	if msg.Type == TypeHeartbeat {
+		msg.Heartbeat = r.heartbeat()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.buf) != 0 {
+		return nil, fmt.Errorf("%d trailing bytes in %s", len(r.buf), msg.Type)
+	}
+	if err := validate(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func validate(msg *Message) error {
+	if !msg.Type.valid() {
+		return fmt.Errorf("unknown message type: %d", uint8(msg.Type))
+	}
+	if msg.Type == TypeHeartbeat {
+		if msg.Heartbeat == nil || msg.Heartbeat.Node == "" {
+			return fmt.Errorf("missing node in %s", msg.Type)
+		}
+		if len(msg.Heartbeat.Node) > maxString || len(msg.Heartbeat.Version) > maxString || len(msg.Heartbeat.VIPs) > maxString {
+			return fmt.Errorf("oversized %s", msg.Type)
+		}
+	}
+	if msg.Type == TypeLookup && msg.Node == "" {
+		return fmt.Errorf("missing node in %s", msg.Type)
+	}
+	if len(msg.Node) > maxString {
+		return fmt.Errorf("oversized node in %s", msg.Type)
+	}
+	if msg.Type.hasFlow() && len(msg.Flow.Addr) != net.IPv4len && len(msg.Flow.Addr) != net.IPv6len {
+		return fmt.Errorf("invalid address in %s: %s", msg.Type, msg.Flow.Addr)
+	}
+	if !msg.Type.hasRepair() {
+		return nil
+	}
+	if msg.Upstream == nil || msg.Downstream == nil {
+		return fmt.Errorf("missing repair state in %s", msg.Type)
+	}
+	for _, repair := range []*Repair{msg.Upstream, msg.Downstream} {
+		if int(repair.SndUnsent) > len(repair.SndQueue) {
+			return fmt.Errorf("invalid unsent length in %s: %d", msg.Type, repair.SndUnsent)
+		}
+		for _, addr := range []net.IP{repair.Saddr, repair.Daddr} {
+			if len(addr) != 0 && len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+				return fmt.Errorf("invalid address in %s: %s", msg.Type, addr)
+			}
+		}
+	}
+	return nil
+}
+
+func putAddr(buf *bytes.Buffer, addr net.IP) {
+	if ip4 := addr.To4(); ip4 != nil {
+		addr = ip4
+	}
+	buf.WriteByte(uint8(len(addr)))
+	buf.Write(addr)
+}
+
+func putUint16(buf *bytes.Buffer, v uint16) {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	buf.Write(b)
+}
+
+func putUint32(buf *bytes.Buffer, v uint32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	buf.Write(b)
+}
+
+func putBytes(buf *bytes.Buffer, v []byte) {
+	putUint32(buf, uint32(len(v)))
+	buf.Write(v)
+}
+
+func putString(buf *bytes.Buffer, v string) {
+	putUint16(buf, uint16(len(v)))
+	buf.WriteString(v)
+}
+
+func putHeartbeat(buf *bytes.Buffer, heartbeat *Heartbeat) {
+	putString(buf, heartbeat.Node)
+	putString(buf, heartbeat.Version)
+	putUint32(buf, heartbeat.Load)
+	putUint16(buf, uint16(len(heartbeat.VIPs)))
+	for _, vip := range heartbeat.VIPs {
+		putAddr(buf, vip)
+	}
+}
+
+func putRepair(buf *bytes.Buffer, repair *Repair) {
+	putAddr(buf, repair.Saddr)
+	putUint16(buf, repair.Sport)
+	putAddr(buf, repair.Daddr)
+	putUint16(buf, repair.Dport)
+	for _, v := range []uint32{
+		repair.SndWl1, repair.SndWnd, repair.MaxWindow, repair.RcvWnd, repair.RcvWup,
+		repair.SndSeq, repair.RcvSeq, repair.Mss, repair.Timestamp,
+	} {
+		putUint32(buf, v)
+	}
+	flags := uint8(0)
+	if repair.Wscale {
+		flags |= flagWscale
+	}
+	if repair.Sack {
+		flags |= flagSack
+	}
+	if repair.Timestamps {
+		flags |= flagTimestamps
+	}
+	buf.Write([]byte{repair.SndWscale, repair.RcvWscale, flags})
+	putBytes(buf, repair.SndQueue)
+	putUint32(buf, repair.SndUnsent)
+	putBytes(buf, repair.RcvQueue)
+}
+
+type reader struct {
+	buf []byte
+	err error
+}
+
+func (r *reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = fmt.Errorf("truncated message: need %d bytes, have %d", n, len(r.buf))
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *reader) uint8() uint8 {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *reader) uint16() uint16 {
+	b := r.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *reader) uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *reader) bytes() []byte {
+	n := r.uint32()
+	if uint64(n) > uint64(len(r.buf)) {
+		if r.err == nil {
+			r.err = fmt.Errorf("truncated message: need %d bytes, have %d", n, len(r.buf))
+		}
+		return nil
+	}
+	return append([]byte{}, r.next(int(n))...)
+}
+
+func (r *reader) addr() net.IP {
+	n := int(r.uint8())
+	if n != 0 && n != net.IPv4len && n != net.IPv6len {
+		if r.err == nil {
+			r.err = fmt.Errorf("invalid address length: %d", n)
+		}
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	return net.IP(append([]byte{}, r.next(n)...))
+}
+
+func (r *reader) string() string {
+	return string(r.next(int(r.uint16())))
+}
+
+func (r *reader) heartbeat() *Heartbeat {
+	heartbeat := &Heartbeat{
+		Node:    r.string(),
+		Version: r.string(),
+		Load:    r.uint32(),
+		VIPs:    []net.IP{},
+	}
+	n := int(r.uint16())
+	for i := 0; i < n && r.err == nil; i++ {
+		heartbeat.VIPs = append(heartbeat.VIPs, r.addr())
+	}
+	return heartbeat
+}
+
+func (r *reader) repair() *Repair {
+	repair := &Repair{}
+	repair.Saddr = r.addr()
+	repair.Sport = r.uint16()
+	repair.Daddr = r.addr()
+	repair.Dport = r.uint16()
+	for _, v := range []*uint32{
+		&repair.SndWl1, &repair.SndWnd, &repair.MaxWindow, &repair.RcvWnd, &repair.RcvWup,
+		&repair.SndSeq, &repair.RcvSeq, &repair.Mss, &repair.Timestamp,
+	} {
+		*v = r.uint32()
+	}
+	repair.SndWscale = r.uint8()
+	repair.RcvWscale = r.uint8()
+	flags := r.uint8()
+	if flags&^(flagWscale|flagSack|flagTimestamps) != 0 && r.err == nil {
+		r.err = fmt.Errorf("unknown option flags: %#x", flags)
+	}
+	repair.Wscale = flags&flagWscale != 0
+	repair.Sack = flags&flagSack != 0
+	repair.Timestamps = flags&flagTimestamps != 0
+	repair.SndQueue = r.bytes()
+	repair.SndUnsent = r.uint32()
+	repair.RcvQueue = r.bytes()
+	return repair
+}
@@ -0,0 +1,229 @@
+package wire
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testRepair(saddr, daddr net.IP) *Repair {
+	return &Repair{
+		Saddr:      saddr,
+		Sport:      80,
+		Daddr:      daddr,
+		Dport:      40000,
+		SndWl1:     1,
+		SndWnd:     2,
+		MaxWindow:  3,
+		RcvWnd:     4,
+		RcvWup:     5,
+		SndSeq:     0xfffffff0,
+		RcvSeq:     7,
+		Mss:        1440,
+		Timestamp:  9,
+		SndWscale:  7,
+		RcvWscale:  8,
+		Wscale:     true,
+		Timestamps: true,
+		SndQueue:   []byte("unacked and unsent"),
+		SndUnsent:  6,
+		RcvQueue:   []byte{},
+	}
+}
+
+func testMessages() map[string]*Message {
+	v6 := net.ParseIP("fc00::1")
+	v4 := net.ParseIP("192.0.2.1").To4()
+	return map[string]*Message{
+		"lookup":       {Type: TypeLookup, Flow: Flow{Addr: v6, Port: 1}, Node: "lb1"},
+		"offer":        {Type: TypeOffer, Flow: Flow{Addr: v4, Port: 2}},
+		"ack":          {Type: TypeAck, Flow: Flow{Addr: v6, Port: 3}, Attempt: 1},
+		"nack":         {Type: TypeNack, Flow: Flow{Addr: v4, Port: 4}, Attempt: 0xffffffff},
+		"release":      {Type: TypeRelease, Flow: Flow{Addr: v6, Port: 0}},
+		"forget":       {Type: TypeForget, Flow: Flow{Addr: v6, Port: 5}},
+		"abort":        {Type: TypeAbort, Flow: Flow{Addr: v6, Port: 6}, Node: "lb2", Attempt: 2},
+		"abort to any": {Type: TypeAbort, Flow: Flow{Addr: v6, Port: 6}},
+		"heartbeat": {Type: TypeHeartbeat, Heartbeat: &Heartbeat{
+			Node:    "lb1",
+			Version: "dev",
+			Load:    42,
+			VIPs:    []net.IP{v6, v4},
+		}},
+		"restore": {
+			Type:       TypeRestore,
+			Flow:       Flow{Addr: v6, Port: 7},
+			Node:       "lb3",
+			Attempt:    3,
+			Upstream:   testRepair(v6, v6),
+			Downstream: testRepair(v6, net.ParseIP("fc00::2")),
+		},
+		"checkpoint": {
+			Type:       TypeCheckpoint,
+			Flow:       Flow{Addr: v4, Port: 8},
+			Upstream:   testRepair(v4, v4),
+			Downstream: testRepair(nil, nil),
+		},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for name, msg := range testMessages() {
+		t.Run(name, func(t *testing.T) {
+			buf, err := Encode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := Decode(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, msg) {
+				t.Errorf("decoded %+v, want %+v", decoded, msg)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for name, msg := range testMessages() {
+		t.Run(name, func(t *testing.T) {
+			buf, err := Encode(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for n := 0; n < len(buf); n++ {
+				if _, err := Decode(buf[:n]); err == nil {
+					t.Errorf("decoded %d of %d bytes", n, len(buf))
+				}
+				// a truncated payload must not pass with a consistent header
+				if n >= headerLen {
+					short := append([]byte{}, buf[:n]...)
+					binary.BigEndian.PutUint32(short[2:], uint32(n-headerLen))
+					if _, err := Decode(short); err == nil {
+						t.Errorf("decoded %d of %d bytes with fixed length", n, len(buf))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	lookup, err := Encode(&Message{Type: TypeLookup, Flow: Flow{Addr: net.ParseIP("fc00::1"), Port: 1}, Node: "lb1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(f func(buf []byte) []byte) []byte {
+		return f(append([]byte{}, lookup...))
+	}
+	tests := []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{
+			name: "empty",
+			buf:  []byte{},
+			err:  "short message",
+		},
+		{
+			name: "unknown version",
+			buf:  modify(func(buf []byte) []byte { buf[0] = Version + 1; return buf }),
+			err:  "unknown protocol version",
+		},
+		{
+			name: "unknown type",
+			buf:  modify(func(buf []byte) []byte { buf[1] = 0xff; return buf }),
+			err:  "unknown message type",
+		},
+		{
+			name: "length mismatch",
+			buf:  modify(func(buf []byte) []byte { return append(buf, 0) }),
+			err:  "length mismatch",
+		},
+		{
+			name: "trailing bytes",
+			buf: modify(func(buf []byte) []byte {
+				buf = append(buf, 0)
+				binary.BigEndian.PutUint32(buf[2:], uint32(len(buf)-headerLen))
+				return buf
+			}),
+			err: "trailing bytes",
+		},
+		{
+			name: "bad address length",
+			buf:  modify(func(buf []byte) []byte { buf[headerLen] = 5; return buf }),
+			err:  "invalid address length",
+		},
+		{
+			name: "missing flow address",
+			buf:  []byte{Version, uint8(TypeAck), 0, 0, 0, 7, 0, 0, 1, 0, 0, 0, 1},
+			err:  "invalid address",
+		},
+		{
+			name: "lookup without node",
+			buf: func() []byte {
+				buf := append([]byte{Version, uint8(TypeLookup), 0, 0, 0, 0}, 4, 192, 0, 2, 1, 0, 1, 0, 0)
+				binary.BigEndian.PutUint32(buf[2:], uint32(len(buf)-headerLen))
+				return buf
+			}(),
+			err: "missing node",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Decode(test.buf)
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+	if _, err := Decode(modify(func(buf []byte) []byte { buf[0] = 9; return buf })); err == nil {
+		t.Error("decoded unknown version")
+	} else if verr, ok := err.(*VersionError); !ok || verr.Version != 9 {
+		t.Errorf("got %#v, want VersionError", err)
+	}
+}
+
+func TestDecodeUnknownRepairFlags(t *testing.T) {
+	msg := testMessages()["checkpoint"]
+	buf, err := Encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flags of the upstream repair follow the flow, both addresses and ports
+	// and the nine 32 bit fields and two window scales
+	offset := headerLen + 1 + net.IPv4len + 2 + 2*(1+net.IPv4len+2) + 9*4 + 2
+	buf[offset] |= 0x80
+	if _, err := Decode(buf); err == nil || !strings.Contains(err.Error(), "unknown option flags") {
+		t.Errorf("got error %v, want unknown option flags", err)
+	}
+}
+
+func TestEncodeInvalid(t *testing.T) {
+	v6 := net.ParseIP("fc00::1")
+	unsent := testRepair(v6, v6)
+	unsent.SndUnsent = uint32(len(unsent.SndQueue) + 1)
+	tests := []struct {
+		name string
+		msg  *Message
+	}{
+		{"unknown type", &Message{Type: 0, Flow: Flow{Addr: v6}}},
+		{"missing address", &Message{Type: TypeAck}},
+		{"bad address", &Message{Type: TypeAck, Flow: Flow{Addr: net.IP{1, 2, 3}}}},
+		{"lookup without node", &Message{Type: TypeLookup, Flow: Flow{Addr: v6}}},
+		{"restore without repair", &Message{Type: TypeRestore, Flow: Flow{Addr: v6}}},
+		{"unsent beyond queue", &Message{Type: TypeRestore, Flow: Flow{Addr: v6}, Upstream: unsent, Downstream: testRepair(v6, v6)}},
+		{"heartbeat without node", &Message{Type: TypeHeartbeat, Heartbeat: &Heartbeat{}}},
+		{"oversized node", &Message{Type: TypeLookup, Flow: Flow{Addr: v6}, Node: strings.Repeat("n", maxString+1)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Encode(test.msg); err == nil {
+				t.Error("encoded invalid message")
+			}
+		})
+	}
+}